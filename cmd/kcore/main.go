@@ -18,29 +18,208 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"kcore/pkg/admin"
+	"kcore/pkg/broker"
+	"kcore/pkg/clock"
 	"kcore/pkg/kafka"
+	"kcore/pkg/logging"
+	"kcore/pkg/memory"
 	"kcore/pkg/server"
 )
 
+// QueuedRequestsMemoryFraction is the fraction of the memory limit of the process requests can hold while queued.
+const QueuedRequestsMemoryFraction = 0.25
+
 var (
-	verbose bool
-	address string
-	port    int
+	verbose                     bool
+	address                     string
+	port                        int
+	listeners                   string
+	listenerSecurityProtocolMap string
+	sslCertFile                 string
+	sslKeyFile                  string
+	sslClientCAFile             string
+	sslSessionTickets           bool
+	sslSessionTicketKeysFile    string
+	sslALPNProtocols            string
+	authFailureDelay            time.Duration
+	authFailureMaxDelay         time.Duration
+	authFailureBanThreshold     int
+	authFailureBanDuration      time.Duration
+	requestTimeout              time.Duration
+	socketRequestMaxBytes       int
+	queuedMaxRequestBytes       int64
+	memoryLimitFraction         float64
+	listenerPriorities          string
+	highPriorityPrincipals      string
+	highPriorityReserved        float64
+	queueTimeThreshold          time.Duration
+	loadSheddingPause           time.Duration
+	reusePort                   bool
+	shutdownTimeout             time.Duration
+	adminAddress                string
+	minClientVersions           string
+	logLevels                   string
+	captureFile                 string
+	captureApiKeys              string
+	captureClientIDs            string
+	captureMaxBytes             int64
+	dataDir                     string
+	brokerID                    int
+	brokerIDFromHostname        bool
 )
 
 func init() {
 	flag.BoolVar(&verbose, "verbose", true, "Enable verbose logging")
-	flag.StringVar(&address, "address", "127.0.0.1", "Address to listen on")
+	flag.StringVar(
+		&address, "address", "127.0.0.1",
+		"Address or network interface name to listen on, \"::\" listens on all IPv4 and IPv6 addresses",
+	)
 	flag.IntVar(&port, "port", 9092, "Port to listen on")
+	flag.StringVar(
+		&listeners, "listeners", "",
+		"Comma separated list of NAME://host:port listeners, host being an address, e.g. [::1], or a network "+
+			"interface name. Defaults to PLAINTEXT on address and port",
+	)
+	flag.StringVar(
+		&listenerSecurityProtocolMap, "listener-security-protocol-map", kafka.DefaultListenerSecurityProtocolMap,
+		"Comma separated list of NAME:PROTOCOL pairs mapping listener names to security protocols",
+	)
+	flag.StringVar(&sslCertFile, "ssl-cert-file", "", "PEM certificate file used by SSL listeners")
+	flag.StringVar(&sslKeyFile, "ssl-key-file", "", "PEM private key file used by SSL listeners")
+	flag.StringVar(
+		&sslClientCAFile, "ssl-client-ca-file", "",
+		"PEM CA file used to verify client certificates. If set, SSL listeners require client certificates",
+	)
+	flag.BoolVar(
+		&sslSessionTickets, "ssl-session-tickets", true,
+		"Let clients resume their TLS sessions with session tickets, skipping the full handshake when reconnecting",
+	)
+	flag.StringVar(
+		&sslSessionTicketKeysFile, "ssl-session-ticket-keys-file", "",
+		"File of hex encoded 32 bytes keys, one per line, encrypting session tickets so that they survive restarts "+
+			"and can be shared by brokers. The first key encrypts new tickets. Keys are random and in memory if empty",
+	)
+	flag.StringVar(
+		&sslALPNProtocols, "ssl-alpn-protocols", "",
+		"Comma separated list of ALPN protocols accepted by SSL listeners, by order of preference. ALPN is not "+
+			"negotiated if empty",
+	)
+	flag.DurationVar(
+		&authFailureDelay, "connection-failed-authentication-delay", 100*time.Millisecond,
+		"Delay before closing a connection that failed to authenticate, doubled on consecutive failures",
+	)
+	flag.DurationVar(
+		&authFailureMaxDelay, "connection-failed-authentication-max-delay", 5*time.Second,
+		"Maximum delay before closing a connection that failed to authenticate",
+	)
+	flag.IntVar(
+		&authFailureBanThreshold, "connection-failed-authentication-ban-threshold", 0,
+		"Consecutive authentication failures after which a client IP is banned, 0 disables bans",
+	)
+	flag.DurationVar(
+		&authFailureBanDuration, "connection-failed-authentication-ban-duration", 5*time.Minute,
+		"How long a client IP stays banned after too many authentication failures",
+	)
+	flag.DurationVar(
+		&requestTimeout, "request-timeout", kafka.DefaultRequestTimeout,
+		"Maximum time to handle a request, 0 for no timeout",
+	)
+	flag.IntVar(
+		&socketRequestMaxBytes, "socket-request-max-bytes", kafka.DefaultMaxRequestSize,
+		"Maximum size of a request, connections sending larger requests are closed. 0 for no limit",
+	)
+	flag.Int64Var(
+		&queuedMaxRequestBytes, "queued-max-request-bytes", -1,
+		"Maximum bytes of requests held in memory across all connections before reads are paused, 0 for no limit. "+
+			"If negative, a quarter of the memory limit of the process is used, or no limit if it has none",
+	)
+	flag.StringVar(
+		&listenerPriorities, "listener-priorities", "",
+		"Comma separated list of NAME:PRIORITY pairs, the connections of HIGH priority listeners are served first "+
+			"when the broker is overloaded",
+	)
+	flag.StringVar(
+		&highPriorityPrincipals, "high-priority-principals", "",
+		"Comma separated list of principals whose connections have a HIGH priority, e.g. User:CN=admin",
+	)
+	flag.Float64Var(
+		&highPriorityReserved, "high-priority-reserved-fraction", 0.1,
+		"Fraction of -queued-max-request-bytes only HIGH priority connections can use",
+	)
+	flag.DurationVar(
+		&queueTimeThreshold, "queue-time-threshold", 0,
+		"Average time requests wait for memory above which the heaviest NORMAL priority connections are paused, "+
+			"0 disables load shedding",
+	)
+	flag.DurationVar(
+		&loadSheddingPause, "load-shedding-pause", 100*time.Millisecond,
+		"How long a connection is paused before reading its next request when the broker sheds load",
+	)
+	flag.Float64Var(
+		&memoryLimitFraction, "memory-limit-fraction", 0.9,
+		"Fraction of the cgroup memory limit used as the soft memory limit of the Go runtime if GOMEMLIMIT is unset",
+	)
+	flag.BoolVar(
+		&reusePort, "reuse-port", false,
+		"Set SO_REUSEPORT on listening sockets so that another kcore process can listen on the same ports",
+	)
+	flag.DurationVar(
+		&shutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"Maximum time to wait for in-flight requests to complete when shutting down or upgrading",
+	)
+	flag.StringVar(
+		&adminAddress, "admin-address", "", "Address of the admin HTTP API, e.g. 127.0.0.1:9093. Disabled if empty",
+	)
+	flag.StringVar(
+		&minClientVersions, "min-client-versions", "",
+		"Comma separated list of NAME:VERSION pairs, clients reporting an older software version are logged",
+	)
+	flag.StringVar(
+		&logLevels, "log-levels", "",
+		"Comma separated list of MODULE=LEVEL pairs overriding the log level of modules, e.g. server=debug,kafka=warn",
+	)
+	flag.StringVar(
+		&captureFile, "capture-file", "",
+		"File the raw requests and responses are appended to as hex dumps, for debugging. Disabled if empty",
+	)
+	flag.StringVar(
+		&captureApiKeys, "capture-api-keys", "", "Comma separated list of API keys to capture, all if empty",
+	)
+	flag.StringVar(
+		&captureClientIDs, "capture-client-ids", "", "Comma separated list of client ids to capture, all if empty",
+	)
+	flag.Int64Var(
+		&captureMaxBytes, "capture-max-bytes", 100*1024*1024, "Size of the capture file after which capturing stops",
+	)
+	flag.StringVar(&dataDir, "data-dir", "/tmp/kcore-data", "Directory the broker keeps its state in")
+	flag.IntVar(
+		&brokerID, "broker-id", -1,
+		"ID of the broker, up to 1000. If negative, the ID stored in the data directory or a generated one is used",
+	)
+	flag.BoolVar(
+		&brokerIDFromHostname, "broker-id-from-hostname", false,
+		"Use the ordinal ending the hostname as broker ID, e.g. 2 for kcore-2, for pods of a Kubernetes StatefulSet",
+	)
 }
 
 func main() {
+	flag.Parse()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -58,27 +237,363 @@ func main() {
 		l = slog.LevelDebug
 		slog.Info("Verbose logging enabled")
 	}
-	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: l})
-	slog.SetDefault(slog.New(h))
-	s := server.NewTCPServer(
-		address, port, func() server.ConnectionHandler {
-			return kafka.NewKafkaConnectionHandler(
-				kafka.NewKafkaApi(),
-			)
-		},
+	levels := logging.NewLevels(l)
+	if err := levels.ParseLevels(logLevels); err != nil {
+		slog.Error("Invalid log levels", "error", err)
+		os.Exit(1)
+	}
+	// The levels are enforced per module, the JSON handler gets everything they let through
+	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(logging.NewHandler(h, levels)))
+	lock, err := broker.LockDataDir(dataDir)
+	if err != nil {
+		slog.Error("Failed to lock data directory", "data dir", dataDir, "error", err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+	if brokerIDFromHostname {
+		id, err := brokerIDOfHost()
+		if err != nil {
+			slog.Error("Failed to get the broker ID from the hostname", "error", err)
+			os.Exit(1)
+		}
+		brokerID = int(id)
+	}
+	identity, err := broker.LoadIdentity(dataDir, int32(brokerID))
+	if err != nil {
+		slog.Error("Failed to load broker identity", "data dir", dataDir, "error", err)
+		os.Exit(1)
+	}
+	// Every log line tells which broker, and which start of it, logged it
+	slog.SetDefault(slog.Default().With("broker id", identity.BrokerID, "incarnation id", identity.IncarnationID))
+	if listeners == "" {
+		listeners = string(kafka.Plaintext) + "://" + net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	ls, err := kafka.ParseListeners(listeners, listenerSecurityProtocolMap)
+	if err != nil {
+		slog.Error("Invalid listeners", "error", err)
+		os.Exit(1)
+	}
+	if err = kafka.ParseListenerPriorities(ls, listenerPriorities); err != nil {
+		slog.Error("Invalid listener priorities", "error", err)
+		os.Exit(1)
+	}
+	minVersions, err := kafka.ParseMinimumClientVersions(minClientVersions)
+	if err != nil {
+		slog.Error("Invalid minimum client versions", "error", err)
+		os.Exit(1)
+	}
+	clients := kafka.NewClientRegistry().WithMinimumVersions(minVersions)
+	inherited, err := server.InheritListeners()
+	if err != nil {
+		slog.Error("Failed to inherit listeners", "error", err)
+		os.Exit(1)
+	}
+	if memoryLimitFraction <= 0 || memoryLimitFraction > 1 {
+		slog.Error("Invalid memory limit fraction, expected a value between 0 and 1", "fraction", memoryLimitFraction)
+		os.Exit(1)
+	}
+	// Keep the heap below the limit of the container, and size the memory held by the broker from that limit
+	budget := memory.NewBudget(memory.SetCgroupMemoryLimit(memory.CgroupRoot, memoryLimitFraction))
+	if queuedMaxRequestBytes < 0 {
+		if queuedMaxRequestBytes, err = budget.Reserve("queued requests", QueuedRequestsMemoryFraction); err != nil {
+			slog.Error("Failed to size the queued requests", "error", err)
+			os.Exit(1)
+		}
+	}
+	slog.Info("Memory budget", "budget", budget)
+	if highPriorityReserved < 0 || highPriorityReserved > 1 {
+		slog.Error(
+			"Invalid high priority reserved fraction, expected a value between 0 and 1",
+			"fraction", highPriorityReserved,
+		)
+		os.Exit(1)
+	}
+	pool := kafka.NewMemoryPool(queuedMaxRequestBytes).WithReserved(
+		int64(float64(queuedMaxRequestBytes) * highPriorityReserved),
 	)
+	var shedder *kafka.LoadShedder
+	if queueTimeThreshold > 0 {
+		shedder = kafka.NewLoadShedder(queueTimeThreshold, loadSheddingPause, clock.Real)
+	}
+	servers, err := newServers(ls, inherited, clients, pool, shedder)
+	if err != nil {
+		slog.Error("Failed to configure listeners", "error", err)
+		os.Exit(1)
+	}
+
 	slog.Info("Starting kcore...")
-	go func() {
+	started := true
+	for _, s := range servers {
 		if err := s.Start(); err != nil {
 			slog.Error("Failed to start kcore", "error", err)
+			started = false
 			cancel()
+			break
+		}
+	}
+	var adminServer *admin.Server
+	// Closed once the servers are drained, for the shutdown requested through the admin API to return
+	drained := make(chan struct{})
+	if adminAddress != "" {
+		adminServer = admin.NewServer(adminAddress, clients).WithLogLevels(levels).WithIdentity(identity).WithShutdown(
+			func(ctx context.Context) error {
+				cancel()
+				select {
+				case <-drained:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			},
+			// The connections are closed once the shutdown timeout expires, leave them time to do so
+			shutdownTimeout+5*time.Second,
+		)
+		adminServer.WithMemoryPool(pool)
+		if shedder != nil {
+			adminServer.WithLoadShedder(shedder)
 		}
+		if err := adminServer.Start(); err != nil {
+			started = false
+			cancel()
+		}
+		// There is nothing to recover on startup yet, the broker is ready as soon as it accepts connections
+		adminServer.SetReady(started)
+	}
 
+	// Hand the listening sockets over to a new kcore process and drain this one when asked to upgrade
+	upgradeCh := make(chan os.Signal, 1)
+	if sigs := upgradeSignals(); len(sigs) > 0 {
+		signal.Notify(upgradeCh, sigs...)
+	}
+	go func() {
+		for range upgradeCh {
+			slog.Info("Received upgrade signal, starting a new kcore process")
+			if err := upgrade(servers, ls, lock); err != nil {
+				slog.Error("Failed to upgrade kcore", "error", err)
+				continue
+			}
+			cancel()
+			return
+		}
 	}()
+
 	<-ctx.Done()
 	slog.Info("Shutting down kcore...")
+	if adminServer != nil {
+		adminServer.SetReady(false)
+	}
+	shutdown(servers)
+	close(drained)
+	if adminServer != nil {
+		adminServer.Shutdown(context.Background())
+	}
+}
+
+// brokerIDOfHost returns the broker ID given by the hostname of the machine or pod.
+func brokerIDOfHost() (int32, error) {
+	if brokerID >= 0 {
+		return 0, fmt.Errorf("-broker-id and -broker-id-from-hostname can't be used together")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	return broker.BrokerIDFromHostname(hostname)
+}
+
+// shutdown stops accepting connections on all the servers and waits for their in-flight requests to complete, up to
+// the shutdown timeout.
+func shutdown(servers []*server.TCPServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server.TCPServer) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Error("Failed to stop kcore", "error", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// newServers creates a TCP server for each listener. Listeners passed to the process, e.g. by systemd socket
+// activation, are used instead of opening new sockets.
+func newServers(
+	listeners []kafka.Listener,
+	inherited []server.InheritedListener,
+	clients *kafka.ClientRegistry,
+	pool *kafka.MemoryPool,
+	shedder *kafka.LoadShedder,
+) ([]*server.TCPServer, error) {
+	var tlsConfig *tls.Config
+	if requestTimeout < 0 {
+		return nil, fmt.Errorf("invalid request timeout %v, expected 0 or more", requestTimeout)
+	}
+	if socketRequestMaxBytes < 0 {
+		return nil, fmt.Errorf("invalid socket request max bytes %d, expected 0 or more", socketRequestMaxBytes)
+	}
+	config := kafka.DefaultConfig()
+	config.RequestTimeout = requestTimeout
+	config.MaxRequestSize = socketRequestMaxBytes
+	config.QueuedMaxRequestBytes = queuedMaxRequestBytes
+	capture, err := newCapture()
+	if err != nil {
+		return nil, err
+	}
+	config.Capture = capture
+	config.LoadShedder = shedder
+	for _, principal := range strings.Split(highPriorityPrincipals, ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			config.HighPriorityPrincipals = append(config.HighPriorityPrincipals, principal)
+		}
+	}
+	authThrottle := server.NewAuthFailureThrottle(
+		authFailureDelay, authFailureMaxDelay, authFailureBanThreshold, authFailureBanDuration,
+	)
+	servers := make([]*server.TCPServer, 0, len(listeners))
+	for _, l := range listeners {
+		if l.SecurityProtocol.UsesSASL() {
+			return nil, fmt.Errorf("listener %s: SASL authentication is not supported yet", l)
+		}
+		listener := l
+		factory := func() server.ConnectionHandler {
+			return kafka.NewKafkaConnectionHandler(listener, config, pool, clients, kafka.NewKafkaApi(config, clients))
+		}
+		var s *server.TCPServer
+		if l.IsUnix() {
+			s = server.NewUnixServer(l.Path, factory)
+		} else {
+			s = server.NewTCPServer(l.Host, l.Port, factory)
+		}
+		if reusePort {
+			s.WithReusePort()
+		}
+		if i := findInherited(l, inherited); i >= 0 {
+			slog.Info(
+				"Using inherited socket", "listener", l.String(), "address", inherited[i].Listener.Addr().String(),
+			)
+			s.WithListener(inherited[i].Listener)
+			inherited = append(inherited[:i], inherited[i+1:]...)
+		}
+		if l.SecurityProtocol.UsesTLS() {
+			if tlsConfig == nil {
+				var err error
+				if tlsConfig, err = loadTLSConfig(); err != nil {
+					return nil, fmt.Errorf("listener %s: %w", l, err)
+				}
+			}
+			s.WithTLSConfig(tlsConfig).WithAuthFailureThrottle(authThrottle)
+		}
+		slog.Info(
+			"Configured listener", "listener", l.String(), "security protocol", l.SecurityProtocol,
+			"priority", l.Priority.String(),
+		)
+		servers = append(servers, s)
+	}
+	for _, unused := range inherited {
+		slog.Warn(
+			"Inherited socket does not match any listener", "name", unused.Name,
+			"address", unused.Listener.Addr().String(),
+		)
+		unused.Listener.Close()
+	}
+	return servers, nil
+}
+
+// findInherited returns the index of the inherited listener to use for l, or -1 if there is none. Inherited listeners
+// are matched by name first, then by socket path or by port and host.
+func findInherited(l kafka.Listener, inherited []server.InheritedListener) int {
+	for i, in := range inherited {
+		if strings.EqualFold(in.Name, l.Name) {
+			return i
+		}
+	}
+	for i, in := range inherited {
+		if addr, ok := in.Listener.Addr().(*net.UnixAddr); ok && l.IsUnix() && addr.Name == l.Path {
+			return i
+		}
+		addr, ok := in.Listener.Addr().(*net.TCPAddr)
+		if !ok || l.IsUnix() || addr.Port != l.Port {
+			continue
+		}
+		if ip := net.ParseIP(l.Host); l.Host == "" || ip.IsUnspecified() || ip.Equal(addr.IP) {
+			return i
+		}
+	}
+	return -1
+}
+
+// newCapture creates the capture of the requests and responses configured by the capture flags, or nil if capturing
+// is disabled.
+func newCapture() (*kafka.Capture, error) {
+	if captureFile == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(captureFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	capture := kafka.NewCapture(f, captureMaxBytes)
+	if captureApiKeys != "" {
+		var keys []int16
+		for _, s := range strings.Split(captureApiKeys, ",") {
+			key, err := strconv.ParseInt(strings.TrimSpace(s), 10, 16)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("invalid capture API key %q: %w", s, err)
+			}
+			keys = append(keys, int16(key))
+		}
+		capture.WithApiKeys(keys...)
+	}
+	if captureClientIDs != "" {
+		capture.WithClientIDs(strings.Split(captureClientIDs, ",")...)
+	}
+	slog.Warn("Capturing requests and responses, they may contain sensitive data", "file", captureFile)
+	return capture, nil
+}
 
-	if err := s.Stop(); err != nil {
-		slog.Error("Failed to stop kcore", "error", err)
+// loadTLSConfig loads the TLS configuration shared by all the SSL listeners.
+func loadTLSConfig() (*tls.Config, error) {
+	if sslCertFile == "" || sslKeyFile == "" {
+		return nil, errors.New("SSL listeners require -ssl-cert-file and -ssl-key-file")
+	}
+	cert, err := tls.LoadX509KeyPair(sslCertFile, sslKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSL certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		MinVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: !sslSessionTickets,
+	}
+	if sslSessionTicketKeysFile != "" {
+		keys, err := server.LoadSessionTicketKeys(sslSessionTicketKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSL session ticket keys: %w", err)
+		}
+		config.SetSessionTicketKeys(keys)
+	}
+	for _, protocol := range strings.Split(sslALPNProtocols, ",") {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			config.NextProtos = append(config.NextProtos, protocol)
+		}
+	}
+	if sslClientCAFile != "" {
+		pem, err := os.ReadFile(sslClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSL client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in SSL client CA file %s", sslClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return config, nil
 }
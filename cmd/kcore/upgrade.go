@@ -0,0 +1,77 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"kcore/pkg/broker"
+	"kcore/pkg/kafka"
+	"kcore/pkg/server"
+)
+
+// upgrade starts a new kcore process from the current executable, which may have been replaced on disk, and passes it
+// the listening sockets like systemd socket activation does, see server.EnvUpgradeFDs. Once it returns successfully,
+// both processes accept connections on the sockets and this process can be drained. The lock on the data directory is
+// shared with the new process, which keeps it once this one exits.
+func upgrade(servers []*server.TCPServer, listeners []kafka.Listener, lock *broker.Lock) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the kcore executable: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(servers))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(servers))
+	for i, s := range servers {
+		f, err := s.File()
+		if err != nil {
+			return fmt.Errorf("failed to get the socket of listener %s: %w", listeners[i], err)
+		}
+		files = append(files, f)
+		names = append(names, listeners[i].Name)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(
+		os.Environ(),
+		server.EnvUpgradeFDs+"="+strconv.Itoa(len(files)),
+		server.EnvUpgradeFDNames+"="+strings.Join(names, ":"),
+		// The lock follows the sockets, ExtraFiles start at file descriptor 3
+		broker.EnvLockFD+"="+strconv.Itoa(3+len(files)),
+	)
+	cmd.ExtraFiles = append(files[:len(files):len(files)], lock.File())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the new kcore process: %w", err)
+	}
+	// The new process outlives this one, it is not waited for
+	if err = cmd.Process.Release(); err != nil {
+		return fmt.Errorf("failed to release the new kcore process: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "os"
+
+// upgradeSignals returns the signals that trigger a hot upgrade. Hot upgrades are not supported on this platform.
+func upgradeSignals() []os.Signal {
+	return nil
+}
@@ -3,10 +3,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/charmbracelet/glamour"
@@ -29,6 +32,12 @@ const (
 	HelmKafkaChartVersion   = "19.1.5"
 	HelmKafkaChartNamespace = "kafka"
 	HelmKafkaValuesFile     = "config/dev/kafka-values.yaml"
+
+	ConformanceReportFile = "conformance-report.md"
+
+	BenchBaselineFile = "bench-baseline.txt"
+	// BenchMaxRegression is how much slower than the baseline a benchmark may get before Bench fails.
+	BenchMaxRegression = 0.10
 )
 
 var (
@@ -145,6 +154,130 @@ func Check() error {
 	return Test()
 }
 
+// Conformance runs Kafka clients against kcore and writes a compatibility report per API key to
+// conformance-report.md. Scenarios using API keys that kcore does not implement are reported as unsupported, only the
+// other scenarios fail the target. Requires kcat.
+func Conformance() error {
+	if _, err := exec.LookPath("kcat"); err != nil {
+		return fmt.Errorf("kcat is required to run the conformance tests: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Running conformance tests...")
+	return sh.RunV(
+		goexec, "test", "-tags", "conformance", "-count=1", "-v", "./test/conformance", "-args", "-report",
+		wd+"/"+ConformanceReportFile,
+	)
+}
+
+// Chaos runs kcore under injected network faults (delays, partial writes and connection resets) and checks that it
+// recovers from them.
+func Chaos() error {
+	fmt.Println("Running chaos scenarios...")
+	return sh.RunV(goexec, "test", "-tags", "chaos", "-count=1", "-v", "./test/chaos")
+}
+
+// Bench runs the benchmarks and compares them to bench-baseline.txt, failing if one of them is more than 10% slower.
+// The results are stored as the baseline if there is none, run BenchBaseline to update it. Baselines are only
+// comparable on the machine they were recorded on, which is why bench-baseline.txt is ignored by git.
+func Bench() error {
+	results, err := runBenchmarks()
+	if err != nil {
+		return err
+	}
+	baseline, err := os.ReadFile(BenchBaselineFile)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No baseline found, storing the results in %s\n", BenchBaselineFile)
+		return os.WriteFile(BenchBaselineFile, []byte(results), 0o644)
+	}
+	if err != nil {
+		return err
+	}
+
+	before, after := parseBenchmarks(string(baseline)), parseBenchmarks(results)
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var regressions []string
+	for _, name := range names {
+		base, ok := before[name]
+		if !ok {
+			fmt.Printf("%-70s %12.0f ns/op (new)\n", name, after[name])
+			continue
+		}
+		change := after[name]/base - 1
+		fmt.Printf("%-70s %12.0f ns/op %+7.1f%%\n", name, after[name], change*100)
+		if change > BenchMaxRegression {
+			regressions = append(regressions, name)
+		}
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf(
+			"benchmarks more than %.0f%% slower than the baseline: %s", BenchMaxRegression*100,
+			strings.Join(regressions, ", "),
+		)
+	}
+	fmt.Println(GreenMessage.Render("No performance regression"))
+	return nil
+}
+
+// BenchBaseline runs the benchmarks and stores the results as the baseline Bench compares to.
+func BenchBaseline() error {
+	results, err := runBenchmarks()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(BenchBaselineFile, []byte(results), 0o644)
+}
+
+func runBenchmarks() (string, error) {
+	fmt.Println("Running benchmarks...")
+	return sh.Output(goexec, "test", "-run", "^$", "-bench", ".", "-benchmem", "-count", "5", "./...")
+}
+
+// parseBenchmarks returns the median ns/op of each benchmark in the output of go test -bench, by package and name, e.g.
+// kcore/pkg/kafka.BenchmarkHandle-8, since benchmarks of different packages may have the same name.
+func parseBenchmarks(output string) map[string]float64 {
+	samples := make(map[string][]float64)
+	pkg := ""
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "pkg:" {
+			pkg = fields[1]
+			continue
+		}
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") || fields[3] != "ns/op" {
+			continue
+		}
+		if ns, err := strconv.ParseFloat(fields[2], 64); err == nil {
+			name := pkg + "." + fields[0]
+			samples[name] = append(samples[name], ns)
+		}
+	}
+	medians := make(map[string]float64, len(samples))
+	for name, values := range samples {
+		sort.Float64s(values)
+		medians[name] = values[len(values)/2]
+	}
+	return medians
+}
+
+// CrossCheck builds and vets kcore for the other platforms it supports, so that changes to platform specific code,
+// e.g. file locking, are checked without a darwin or windows machine.
+func CrossCheck() error {
+	for _, goos := range []string{"darwin", "windows"} {
+		fmt.Printf("Checking %s...\n", goos)
+		if err := sh.RunWithV(map[string]string{"GOOS": goos}, goexec, "vet", "./..."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func printFile(fName, fType string) error {
 
 	fContent, err := sh.Output("cat", fName)
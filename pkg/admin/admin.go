@@ -0,0 +1,294 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admin implements the HTTP API used by operators to inspect and manage a running broker.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"kcore/pkg/broker"
+	"kcore/pkg/kafka"
+	"kcore/pkg/logging"
+)
+
+// Server serves the admin API. It is meant to listen on a private address, requests are not authenticated.
+type Server struct {
+	address  string
+	clients  *kafka.ClientRegistry
+	levels   *logging.Levels
+	identity broker.Identity
+	ready    atomic.Bool
+	pool     *kafka.MemoryPool
+	shedder  *kafka.LoadShedder
+	mux      *http.ServeMux
+	srv      *http.Server
+	l        net.Listener
+
+	shutdown func(ctx context.Context) error
+	// shutdownTimeout bounds the shutdown requested through the API, shuttingDown is set once it is requested.
+	shutdownTimeout time.Duration
+	shuttingDown    atomic.Bool
+}
+
+// NewServer creates an admin server listening on address, e.g. 127.0.0.1:9093. It does not start the server.
+func NewServer(address string, clients *kafka.ClientRegistry) *Server {
+	s := &Server{
+		address: address,
+		clients: clients,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/admin/clients", s.handleClients)
+	s.mux.HandleFunc("/admin/connections", s.handleConnections)
+	s.mux.HandleFunc("/admin/ready", s.handleReady)
+	s.mux.HandleFunc("/admin/overload", s.handleOverload)
+	s.srv = &http.Server{Handler: s.mux}
+	return s
+}
+
+// WithLogLevels exposes the log levels at /admin/loglevels so that they can be changed without restarting the broker:
+//
+//	GET    /admin/loglevels                            lists the levels, the default level is under "default"
+//	PUT    /admin/loglevels?module=server&level=debug  sets the level of a module, or the default level without module
+//	DELETE /admin/loglevels?module=server              makes the module log at the default level again
+func (s *Server) WithLogLevels(levels *logging.Levels) *Server {
+	s.levels = levels
+	s.mux.HandleFunc("/admin/loglevels", s.handleLogLevels)
+	return s
+}
+
+// WithIdentity exposes the broker and incarnation IDs at /admin/broker, so that a restart can be told apart from a
+// network blip.
+func (s *Server) WithIdentity(identity broker.Identity) *Server {
+	s.identity = identity
+	s.mux.HandleFunc("/admin/broker", s.handleBroker)
+	return s
+}
+
+// WithShutdown makes /admin/shutdown call shutdown, which is expected to drain the broker and return once it is done
+// or ctx is done. The drain is given up to timeout. It is meant for the pre-stop hook of Kubernetes, which waits for
+// the request to complete before stopping the pod.
+func (s *Server) WithShutdown(shutdown func(ctx context.Context) error, timeout time.Duration) *Server {
+	s.shutdown = shutdown
+	s.shutdownTimeout = timeout
+	s.mux.HandleFunc("/admin/shutdown", s.handleShutdown)
+	return s
+}
+
+// WithMemoryPool exposes the usage of the memory pool of the requests at /admin/overload.
+func (s *Server) WithMemoryPool(pool *kafka.MemoryPool) *Server {
+	s.pool = pool
+	return s
+}
+
+// WithLoadShedder exposes the state of the circuit breaker of the load shedder and its metrics at /admin/overload.
+func (s *Server) WithLoadShedder(shedder *kafka.LoadShedder) *Server {
+	s.shedder = shedder
+	return s
+}
+
+// SetReady sets whether the broker is ready to serve clients, as reported by /admin/ready. The broker is not ready
+// until SetReady(true) is called.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start starts serving the admin API in a new goroutine.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		logger().Error("Failed to start admin server", "error", err)
+		return err
+	}
+	s.l = l
+	logger().Info("Admin server listening", "address", l.Addr().String())
+	go func() {
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger().Error("Admin server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on. The server must be started.
+func (s *Server) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Shutdown stops the server, waiting for the requests being handled until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// handleClients lists the connected clients, the software they reported and the requests received from them.
+func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.clients.Clients())
+}
+
+func (s *Server) handleBroker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.identity)
+}
+
+// handleConnections lists the open connections, with the requests received on each of them:
+//
+//	GET    /admin/connections        lists the connections
+//	DELETE /admin/connections?id=42  closes the connection with the given connection_id
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.clients.Clients())
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		found, err := s.clients.Close(id)
+		if !found {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// overload is the body of /admin/overload, the parts that are not configured are omitted.
+type overload struct {
+	MemoryPool  *kafka.MemoryPoolStats  `json:"memory_pool,omitempty"`
+	LoadShedder *kafka.LoadShedderStats `json:"load_shedder,omitempty"`
+}
+
+// handleOverload reports how loaded the broker is: the usage of the memory pool and the state of the load shedder.
+func (s *Server) handleOverload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var o overload
+	if s.pool != nil {
+		stats := s.pool.Stats()
+		o.MemoryPool = &stats
+	}
+	if s.shedder != nil {
+		stats := s.shedder.Stats()
+		o.LoadShedder = &stats
+	}
+	writeJSON(w, o)
+}
+
+// handleReady answers readiness probes, with 503 when the broker is not ready.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// handleShutdown shuts the broker down, answering with 504 if the drain did not complete in time. The shutdown is only
+// run once, later requests are answered with 409. GET is accepted as well as POST since Kubernetes hooks can only send
+// GETs.
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		http.Error(w, "shutdown already requested", http.StatusConflict)
+		return
+	}
+	logger().Info("Shutdown requested through the admin API", "remote address", r.RemoteAddr)
+	s.SetReady(false)
+	ctx, cancel := context.WithTimeout(r.Context(), s.shutdownTimeout)
+	defer cancel()
+	if err := s.shutdown(ctx); err != nil {
+		logger().Warn("Shutdown did not complete in time", "timeout", s.shutdownTimeout, "error", err)
+		http.Error(w, "shutdown did not complete: "+err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	w.Write([]byte("shut down\n"))
+}
+
+func (s *Server) handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	module := r.URL.Query().Get("module")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.levels.Set(module, level)
+		logger().Info("Changed log level", "log module", module, "level", level)
+	case http.MethodDelete:
+		if module == "" {
+			http.Error(w, "module is required", http.StatusBadRequest)
+			return
+		}
+		s.levels.Reset(module)
+		logger().Info("Reset log level", "log module", module)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	levels := make(map[string]string)
+	for module, level := range s.levels.All() {
+		if module == "" {
+			module = "default"
+		}
+		levels[module] = level.String()
+	}
+	writeJSON(w, levels)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger().Error("Failed to write admin response", "error", err)
+	}
+}
+
+// logger returns the logger of the admin module, whose level can be changed at runtime.
+func logger() *slog.Logger {
+	return logging.Module("admin")
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"kcore/pkg/broker"
+	"kcore/pkg/clock"
+	"kcore/pkg/kafka"
+	"kcore/pkg/logging"
+)
+
+func startServer(t *testing.T, s *Server) *Server {
+	t.Helper()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	t.Cleanup(
+		func() {
+			s.Shutdown(context.Background())
+		},
+	)
+	return s
+}
+
+func TestClients(t *testing.T) {
+	clients := kafka.NewClientRegistry()
+	session := kafka.NewSession(kafka.Listener{Name: "PLAINTEXT"}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242})
+	session.ClientSoftwareName = "librdkafka"
+	session.ClientSoftwareVersion = "2.3.0"
+	clients.Register(session, nil)
+	s := startServer(t, NewServer("127.0.0.1:0", clients))
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/admin/clients")
+	if err != nil {
+		t.Fatalf("Failed to list clients: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var got []kafka.ClientInfo
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode clients: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 client, got %+v", got)
+	}
+	if got[0].RemoteAddress != "10.0.0.1:4242" || got[0].SoftwareName != "librdkafka" ||
+		got[0].SoftwareVersion != "2.3.0" {
+		t.Fatalf("Unexpected client: %+v", got[0])
+	}
+
+	resp, err = http.Post("http://"+s.Addr().String()+"/admin/clients", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to post clients: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	levels := logging.NewLevels(slog.LevelInfo)
+	s := startServer(t, NewServer("127.0.0.1:0", kafka.NewClientRegistry()).WithLogLevels(levels))
+	url := "http://" + s.Addr().String() + "/admin/loglevels"
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+		want       map[string]string
+	}{
+		{"List", http.MethodGet, "", http.StatusOK, map[string]string{"default": "INFO"}},
+		{
+			"Set module level", http.MethodPut, "?module=server&level=debug", http.StatusOK,
+			map[string]string{"default": "INFO", "server": "DEBUG"},
+		},
+		{
+			"Set default level", http.MethodPut, "?level=warn", http.StatusOK,
+			map[string]string{"default": "WARN", "server": "DEBUG"},
+		},
+		{"Invalid level", http.MethodPut, "?module=server&level=verbose", http.StatusBadRequest, nil},
+		{
+			"Reset module level", http.MethodDelete, "?module=server", http.StatusOK,
+			map[string]string{"default": "WARN"},
+		},
+		{"Reset without module", http.MethodDelete, "", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				req, err := http.NewRequest(tt.method, url+tt.query, nil)
+				if err != nil {
+					t.Fatalf("Failed to create request: %v", err)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Failed to send request: %v", err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+				}
+				if tt.want == nil {
+					return
+				}
+				var got map[string]string
+				if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+					t.Fatalf("Failed to decode levels: %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("Expected levels %v, got %v", tt.want, got)
+				}
+			},
+		)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	identity := broker.Identity{BrokerID: 1, IncarnationID: "Xt2pSbxYTD-Tp3DNPMzRcw"}
+	s := startServer(t, NewServer("127.0.0.1:0", kafka.NewClientRegistry()).WithIdentity(identity))
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/admin/broker")
+	if err != nil {
+		t.Fatalf("Failed to get broker: %v", err)
+	}
+	defer resp.Body.Close()
+	var got broker.Identity
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode broker: %v", err)
+	}
+	if got != identity {
+		t.Fatalf("Expected %+v, got %+v", identity, got)
+	}
+}
+
+func TestReadyAndShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	s := startServer(
+		t, NewServer("127.0.0.1:0", kafka.NewClientRegistry()).WithShutdown(
+			func(ctx context.Context) error {
+				close(shutdown)
+				return nil
+			}, time.Second,
+		),
+	)
+	ready := func() int {
+		resp, err := http.Get("http://" + s.Addr().String() + "/admin/ready")
+		if err != nil {
+			t.Fatalf("Failed to get readiness: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 before the broker is ready, got %d", status)
+	}
+	s.SetReady(true)
+	if status := ready(); status != http.StatusOK {
+		t.Fatalf("Expected status 200 once the broker is ready, got %d", status)
+	}
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/admin/shutdown")
+	if err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	select {
+	case <-shutdown:
+	default:
+		t.Fatalf("Expected shutdown to be called")
+	}
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 once shutting down, got %d", status)
+	}
+
+	// The shutdown is not run twice
+	resp, err = http.Post("http://"+s.Addr().String()+"/admin/shutdown", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status 409 for a repeated shutdown, got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := startServer(
+		t, NewServer("127.0.0.1:0", kafka.NewClientRegistry()).WithShutdown(
+			func(ctx context.Context) error {
+				// A connection that never drains
+				<-ctx.Done()
+				return ctx.Err()
+			}, 10*time.Millisecond,
+		),
+	)
+	resp, err := http.Get("http://" + s.Addr().String() + "/admin/shutdown")
+	if err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status 504, got %d", resp.StatusCode)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	clients := kafka.NewClientRegistry()
+	session := kafka.NewSession(kafka.Listener{Name: "PLAINTEXT"}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242})
+	server, client := net.Pipe()
+	defer client.Close()
+	clients.Register(session, server)
+	clients.RecordRequest(session, kafka.ApiVersionsApiKey)
+	s := startServer(t, NewServer("127.0.0.1:0", clients))
+	url := "http://" + s.Addr().String() + "/admin/connections"
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to list connections: %v", err)
+	}
+	var got []kafka.ClientInfo
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode connections: %v", err)
+	}
+	if len(got) != 1 || got[0].ConnectionID != session.ID || got[0].Requests[kafka.ApiVersionsApiKey] != 1 {
+		t.Fatalf("Unexpected connections: %+v", got)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+	}{
+		{"Unsupported method", http.MethodPost, "", http.StatusMethodNotAllowed},
+		{"Invalid id", http.MethodDelete, "?id=abc", http.StatusBadRequest},
+		{"Unknown connection", http.MethodDelete, "?id=0", http.StatusNotFound},
+		{"Close connection", http.MethodDelete, "?id=" + strconv.FormatUint(session.ID, 10), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				req, err := http.NewRequest(tt.method, url+tt.query, nil)
+				if err != nil {
+					t.Fatalf("Failed to create request: %v", err)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Failed to send request: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+				}
+			},
+		)
+	}
+	if _, err = client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected the connection to be closed")
+	}
+}
+
+func TestOverload(t *testing.T) {
+	pool := kafka.NewMemoryPool(1000)
+	pool.Acquire(context.Background(), 250)
+	shedder := kafka.NewLoadShedder(100*time.Millisecond, 50*time.Millisecond, clock.Real)
+	s := startServer(
+		t, NewServer("127.0.0.1:0", kafka.NewClientRegistry()).WithMemoryPool(pool).WithLoadShedder(shedder),
+	)
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/admin/overload")
+	if err != nil {
+		t.Fatalf("Failed to get the overload state: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var got map[string]map[string]any
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode the overload state: %v", err)
+	}
+	if got["memory_pool"]["used_bytes"] != 250.0 || got["memory_pool"]["saturation"] != 0.25 {
+		t.Fatalf("Unexpected memory pool state: %+v", got["memory_pool"])
+	}
+	shedding := got["load_shedder"]
+	if shedding["state"] != "closed" || shedding["threshold_ms"] != 100.0 || shedding["trips"] != 0.0 {
+		t.Fatalf("Unexpected load shedder state: %+v", shedding)
+	}
+}
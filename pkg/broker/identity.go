@@ -0,0 +1,160 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package broker holds the identity of the broker and the state it keeps in its data directory.
+package broker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MetaPropertiesFile is the file of the data directory the broker ID is stored in, like Kafka's meta.properties.
+	MetaPropertiesFile = "meta.properties"
+	// MaxReservedBrokerID is the highest broker ID that can be configured. Generated IDs are above it so that they
+	// don't collide with configured ones, as with Kafka's reserved.broker.max.id.
+	MaxReservedBrokerID = 1000
+)
+
+// Identity identifies a broker and the process running it.
+type Identity struct {
+	// BrokerID is persisted in the data directory and stays the same across restarts.
+	BrokerID int32 `json:"broker_id"`
+	// IncarnationID changes every time the broker starts, so that clients and logs can tell restarts apart.
+	IncarnationID string `json:"incarnation_id"`
+}
+
+// LoadIdentity returns the identity of the broker using dataDir. The broker ID stored in the data directory is used,
+// or brokerID is stored if there is none yet. A negative brokerID generates a new ID. It is an error for brokerID to
+// differ from the stored ID, which would mean the data directory belongs to another broker.
+func LoadIdentity(dataDir string, brokerID int32) (Identity, error) {
+	if brokerID > MaxReservedBrokerID {
+		return Identity{}, fmt.Errorf("broker ID %d is above the maximum of %d", brokerID, MaxReservedBrokerID)
+	}
+	path := filepath.Join(dataDir, MetaPropertiesFile)
+	stored, err := readBrokerID(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if brokerID < 0 {
+			if brokerID, err = generateBrokerID(); err != nil {
+				return Identity{}, err
+			}
+		}
+		if err = writeBrokerID(dataDir, path, brokerID); err != nil {
+			return Identity{}, err
+		}
+	case err != nil:
+		return Identity{}, err
+	case brokerID >= 0 && brokerID != stored:
+		return Identity{}, fmt.Errorf(
+			"broker ID %d does not match the ID %d stored in %s, is the data directory of another broker?", brokerID,
+			stored, path,
+		)
+	default:
+		brokerID = stored
+	}
+
+	incarnationID, err := NewIncarnationID()
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{BrokerID: brokerID, IncarnationID: incarnationID}, nil
+}
+
+// BrokerIDFromHostname returns the ordinal that ends hostname, e.g. 2 for kcore-2, so that the pods of a Kubernetes
+// StatefulSet get their broker ID from their name.
+func BrokerIDFromHostname(hostname string) (int32, error) {
+	// Pods may be given their fully qualified name
+	name, _, _ := strings.Cut(hostname, ".")
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("hostname %q does not end with an ordinal, e.g. kcore-0", hostname)
+	}
+	id, err := strconv.ParseInt(name[i+1:], 10, 32)
+	if err != nil || id < 0 || id > MaxReservedBrokerID {
+		return 0, fmt.Errorf("hostname %q does not end with an ordinal between 0 and %d", hostname, MaxReservedBrokerID)
+	}
+	return int32(id), nil
+}
+
+// NewIncarnationID returns a random ID formatted like Kafka's UUIDs: 16 bytes in unpadded URL safe base64.
+func NewIncarnationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate incarnation ID: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func generateBrokerID() (int32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, fmt.Errorf("failed to generate broker ID: %w", err)
+	}
+	n := binary.BigEndian.Uint32(b) % (math.MaxInt32 - MaxReservedBrokerID)
+	return int32(n) + MaxReservedBrokerID + 1, nil
+}
+
+func readBrokerID(path string) (int32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || key != "broker.id" {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil || id < 0 {
+			return 0, fmt.Errorf("invalid broker.id %q in %s", value, path)
+		}
+		return int32(id), nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return 0, fmt.Errorf("no broker.id in %s", path)
+}
+
+// writeBrokerID writes the properties file through a temporary file, so that a crash never leaves a partial file.
+func writeBrokerID(dataDir, path string, brokerID int32) error {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	content := fmt.Sprintf("# Written by kcore, do not edit\nversion=0\nbroker.id=%d\n", brokerID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   string
+		brokerID int32
+		want     int32
+		wantErr  bool
+	}{
+		{"Configured ID is stored", "", 3, 3, false},
+		{"Stored ID is used", "broker.id=7\n", -1, 7, false},
+		{"Matching IDs", "version=0\nbroker.id=7\n", 7, 7, false},
+		{"Mismatching IDs", "broker.id=7\n", 3, 0, true},
+		{"Invalid stored ID", "broker.id=seven\n", -1, 0, true},
+		{"Configured ID above the reserved range", "", MaxReservedBrokerID + 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				if tt.stored != "" {
+					path := filepath.Join(dir, MetaPropertiesFile)
+					if err := os.WriteFile(path, []byte(tt.stored), 0o644); err != nil {
+						t.Fatalf("Failed to write properties: %v", err)
+					}
+				}
+				got, err := LoadIdentity(dir, tt.brokerID)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("LoadIdentity() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if tt.wantErr {
+					return
+				}
+				if got.BrokerID != tt.want {
+					t.Fatalf("Expected broker ID %d, got %d", tt.want, got.BrokerID)
+				}
+				if got.IncarnationID == "" {
+					t.Fatalf("Expected an incarnation ID")
+				}
+			},
+		)
+	}
+}
+
+func TestLoadIdentityAcrossRestarts(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	first, err := LoadIdentity(dir, -1)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if first.BrokerID <= MaxReservedBrokerID {
+		t.Fatalf("Expected a generated broker ID above %d, got %d", MaxReservedBrokerID, first.BrokerID)
+	}
+	second, err := LoadIdentity(dir, -1)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if second.BrokerID != first.BrokerID {
+		t.Fatalf("Expected the broker ID to be kept across restarts, got %d then %d", first.BrokerID, second.BrokerID)
+	}
+	if second.IncarnationID == first.IncarnationID {
+		t.Fatalf("Expected a new incarnation ID after a restart")
+	}
+}
+
+func TestBrokerIDFromHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		want     int32
+		wantErr  bool
+	}{
+		{"StatefulSet pod", "kcore-2", 2, false},
+		{"Fully qualified name", "kcore-12.kcore.default.svc.cluster.local", 12, false},
+		{"Name with dashes", "my-kcore-0", 0, false},
+		{"No ordinal", "kcore", 0, true},
+		{"Not a number", "kcore-abc", 0, true},
+		{"Ordinal above the reserved range", "kcore-1001", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got, err := BrokerIDFromHostname(tt.hostname)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("BrokerIDFromHostname() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Fatalf("Expected broker ID %d, got %d", tt.want, got)
+				}
+			},
+		)
+	}
+}
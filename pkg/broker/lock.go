@@ -0,0 +1,110 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// LockFile is the file of the data directory a broker holds a lock on while it uses the directory.
+	LockFile = ".lock"
+	// EnvLockFD is the environment variable a kcore process being upgraded passes the file descriptor of its lock in,
+	// so that the new process takes the lock over instead of failing to acquire it.
+	EnvLockFD = "KCORE_DATA_DIR_LOCK_FD"
+)
+
+// ErrLocked is returned when the data directory is locked by another process.
+var ErrLocked = errors.New("data directory is used by another process")
+
+// Lock is an advisory lock on a data directory, preventing two brokers from using the same directory. The lock is
+// released by the operating system when the process exits, a lock file left behind does not prevent a restart.
+type Lock struct {
+	f *os.File
+}
+
+// LockDataDir locks dataDir, creating it if needed. The lock passed by the parent process in EnvLockFD is used if any.
+func LockDataDir(dataDir string) (*Lock, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	path := filepath.Join(dataDir, LockFile)
+	if fd := os.Getenv(EnvLockFD); fd != "" {
+		os.Unsetenv(EnvLockFD)
+		return inheritLock(path, fd)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dataDir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return newLock(f)
+}
+
+// newLock writes the PID to the locked file f. The PID only helps operators find the process using the directory, the
+// lock is what matters.
+func newLock(f *os.File) (*Lock, error) {
+	err := f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write %s: %w", f.Name(), err)
+	}
+	return &Lock{f: f}, nil
+}
+
+// inheritLock returns the lock held on the file descriptor fd, after checking that it is the lock file at path.
+func inheritLock(path, fd string) (*Lock, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", EnvLockFD, fd)
+	}
+	f := os.NewFile(uintptr(n), path)
+	inherited, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid inherited lock: %w", err)
+	}
+	if expected, err := os.Stat(path); err != nil || !os.SameFile(inherited, expected) {
+		f.Close()
+		return nil, fmt.Errorf("inherited lock is not %s", path)
+	}
+	return newLock(f)
+}
+
+// File returns the locked file, to be passed to the process taking the data directory over.
+func (l *Lock) File() *os.File {
+	return l.f
+}
+
+// Unlock releases the lock. The lock file is not removed, another process may already have opened it.
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
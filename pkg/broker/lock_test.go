@@ -0,0 +1,50 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	lock, err := LockDataDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock data directory: %v", err)
+	}
+	if _, err = LockDataDir(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked while the directory is locked, got %v", err)
+	}
+	if err = lock.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock data directory: %v", err)
+	}
+	lock, err = LockDataDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock data directory after it was unlocked: %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockDataDirInheritedLock(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(EnvLockFD, "not a file descriptor")
+	if _, err := LockDataDir(dir); err == nil {
+		t.Fatalf("Expected an error for an invalid inherited lock")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chaos injects network faults, such as delays, partial writes and connection resets, to validate how kcore
+// recovers from them. The faults are only injected by binaries built with the chaos build tag, see Enabled.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvFaults is the environment variable holding the faults injected by a chaos build, e.g.
+// "read-delay=10ms,write-delay=5ms,partial-writes=0.1,resets=0.01,seed=42".
+const EnvFaults = "KCORE_CHAOS"
+
+var (
+	// ErrInjectedReset is returned by the reads and writes of a connection reset by the fault injection.
+	ErrInjectedReset = errors.New("chaos: connection reset")
+	// ErrInjectedPartialWrite is returned by writes cut short by the fault injection.
+	ErrInjectedPartialWrite = errors.New("chaos: partial write")
+)
+
+// Faults describes the faults injected in connections. Probabilities are between 0 and 1 and apply to every read or
+// write.
+type Faults struct {
+	ReadDelay    time.Duration
+	WriteDelay   time.Duration
+	PartialWrite float64
+	Reset        float64
+	// Seed makes the injected faults reproducible. 0 uses the current time.
+	Seed int64
+}
+
+// ParseFaults parses a comma separated list of key=value faults, see EnvFaults.
+func ParseFaults(s string) (Faults, error) {
+	var f Faults
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return Faults{}, fmt.Errorf("invalid fault %q, expected key=value", entry)
+		}
+		var err error
+		switch key {
+		case "read-delay":
+			f.ReadDelay, err = time.ParseDuration(value)
+		case "write-delay":
+			f.WriteDelay, err = time.ParseDuration(value)
+		case "partial-writes":
+			f.PartialWrite, err = parseProbability(value)
+		case "resets":
+			f.Reset, err = parseProbability(value)
+		case "seed":
+			f.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return Faults{}, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return Faults{}, fmt.Errorf("invalid fault %q: %w", entry, err)
+		}
+	}
+	return f, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability %v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+// FromEnv returns the faults set in EnvFaults.
+func FromEnv() (Faults, error) {
+	return ParseFaults(os.Getenv(EnvFaults))
+}
+
+// Injector decides which faults to inject. A single injector is shared by the connections of a listener so that a
+// seeded run is reproducible.
+type Injector struct {
+	faults Faults
+	mu     sync.Mutex
+	rand   *rand.Rand
+}
+
+// NewInjector creates an injector of the given faults.
+func NewInjector(faults Faults) *Injector {
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{faults: faults, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (i *Injector) happens(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < p
+}
+
+// WrapConn returns a connection injecting faults in the reads and writes of conn.
+func (i *Injector) WrapConn(conn net.Conn) net.Conn {
+	return &faultyConn{Conn: conn, injector: i}
+}
+
+// WrapListener returns a listener whose accepted connections inject faults.
+func (i *Injector) WrapListener(l net.Listener) net.Listener {
+	return &faultyListener{Listener: l, injector: i}
+}
+
+type faultyListener struct {
+	net.Listener
+	injector *Injector
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.injector.WrapConn(conn), nil
+}
+
+type faultyConn struct {
+	net.Conn
+	injector *Injector
+}
+
+func (c *faultyConn) Read(b []byte) (int, error) {
+	time.Sleep(c.injector.faults.ReadDelay)
+	if c.injector.happens(c.injector.faults.Reset) {
+		c.Conn.Close()
+		return 0, ErrInjectedReset
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	time.Sleep(c.injector.faults.WriteDelay)
+	if c.injector.happens(c.injector.faults.Reset) {
+		c.Conn.Close()
+		return 0, ErrInjectedReset
+	}
+	if len(b) > 1 && c.injector.happens(c.injector.faults.PartialWrite) {
+		n, err := c.Conn.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrInjectedPartialWrite
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Faults
+		wantErr bool
+	}{
+		{"No faults", "", Faults{}, false},
+		{
+			"All faults", "read-delay=10ms, write-delay=5ms,partial-writes=0.1,resets=0.01,seed=42",
+			Faults{
+				ReadDelay: 10 * time.Millisecond, WriteDelay: 5 * time.Millisecond, PartialWrite: 0.1, Reset: 0.01,
+				Seed: 42,
+			},
+			false,
+		},
+		{"Unknown fault", "fsync-failures=0.1", Faults{}, true},
+		{"Probability out of range", "resets=2", Faults{}, true},
+		{"Missing value", "resets", Faults{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got, err := ParseFaults(tt.s)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseFaults() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Fatalf("ParseFaults() got = %+v, want %+v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func TestFaultyConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		faults  Faults
+		wantN   int
+		wantErr error
+	}{
+		{"No faults", Faults{}, 4, nil},
+		{"Partial write", Faults{PartialWrite: 1}, 2, ErrInjectedPartialWrite},
+		{"Reset", Faults{Reset: 1}, 0, ErrInjectedReset},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				client, server := net.Pipe()
+				defer client.Close()
+				conn := NewInjector(tt.faults).WrapConn(server)
+				defer conn.Close()
+
+				read := make(chan []byte, 1)
+				go func() {
+					b, _ := io.ReadAll(client)
+					read <- b
+				}()
+				n, err := conn.Write([]byte("ping"))
+				if n != tt.wantN || !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Write() = %d, %v, want %d, %v", n, err, tt.wantN, tt.wantErr)
+				}
+				conn.Close()
+				if b := <-read; len(b) != tt.wantN {
+					t.Fatalf("Expected the peer to receive %d bytes, got %d", tt.wantN, len(b))
+				}
+			},
+		)
+	}
+}
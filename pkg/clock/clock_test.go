@@ -0,0 +1,38 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewFake(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("Expected the clock to start at %s, got %s", start, c.Now())
+	}
+	c.Advance(time.Minute)
+	if want := start.Add(time.Minute); !c.Now().Equal(want) {
+		t.Fatalf("Expected the clock to be advanced to %s, got %s", want, c.Now())
+	}
+	c.Set(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("Expected the clock to be set back to %s, got %s", start, c.Now())
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kafka/kafkatest"
+)
+
+// PipelinedRequests is the number of requests a client sends at once in BenchmarkConnectionPipelined.
+const PipelinedRequests = 100
+
+func newBenchmarkRequest(b *testing.B) EncodedRequest {
+	b.Helper()
+	encoded, err := kafkatest.EncodeRequest(
+		kafkatest.NewRequest(
+			1, "bench", &sarama.ApiVersionsRequest{
+				Version:               3,
+				ClientSoftwareName:    "kcore-bench",
+				ClientSoftwareVersion: "1.0.0",
+			},
+		),
+	)
+	if err != nil {
+		b.Fatalf("Failed to encode request: %v", err)
+	}
+	return encoded
+}
+
+// BenchmarkHandle measures the request path without the network: decode, dispatch and encode.
+func BenchmarkHandle(b *testing.B) {
+	clients := NewClientRegistry()
+	api := NewKafkaApi(DefaultConfig(), clients)
+	session := NewSession(TestListener, kafkatest.DefaultRemoteAddr)
+	clients.Register(session, nil)
+	ctx := NewSessionContext(context.Background(), session)
+	req := newBenchmarkRequest(b)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := api.Handle(ctx, req); err != nil {
+			b.Fatalf("Failed to handle request: %v", err)
+		}
+	}
+}
+
+// BenchmarkConnectionPipelined measures a connection answering a batch of pipelined requests, including the memory
+// pool accounting and the batched response writes.
+func BenchmarkConnectionPipelined(b *testing.B) {
+	config := DefaultConfig()
+	clients := NewClientRegistry()
+	pool := NewMemoryPool(0)
+	request := kafkatest.NewRequest(
+		1, "bench", &sarama.ApiVersionsRequest{
+			Version:               3,
+			ClientSoftwareName:    "kcore-bench",
+			ClientSoftwareVersion: "1.0.0",
+		},
+	)
+	size := len(newBenchmarkRequest(b))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size * PipelinedRequests))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		conn := kafkatest.NewConn()
+		for j := 0; j < PipelinedRequests; j++ {
+			conn.WithRequest(request)
+		}
+		b.StartTimer()
+		NewKafkaConnectionHandler(TestListener, config, pool, clients, NewKafkaApi(config, clients)).
+			HandleConnection(conn)
+	}
+}
+
+const (
+	// ProduceBenchmarkRecords is the number of records in the batch of BenchmarkProduceCodec.
+	ProduceBenchmarkRecords = 100
+	// ProduceBenchmarkRecordBytes is the size of the value of each record in the batch of BenchmarkProduceCodec.
+	ProduceBenchmarkRecordBytes = 100
+)
+
+// BenchmarkProduceCodec measures the codec of the produce path: decoding a Produce request with its record batch and
+// encoding the response. Records are not appended to a log, the broker does not handle Produce requests yet.
+func BenchmarkProduceCodec(b *testing.B) {
+	records := make([]*sarama.Record, ProduceBenchmarkRecords)
+	for i := range records {
+		records[i] = &sarama.Record{OffsetDelta: int64(i), Value: make([]byte, ProduceBenchmarkRecordBytes)}
+	}
+	produce := &sarama.ProduceRequest{Version: 7, RequiredAcks: sarama.WaitForAll, Timeout: 1000}
+	produce.AddBatch(
+		"bench", 0, &sarama.RecordBatch{
+			Version:         2,
+			LastOffsetDelta: ProduceBenchmarkRecords - 1,
+			Records:         records,
+		},
+	)
+	req, err := kafkatest.EncodeRequest(kafkatest.NewRequest(1, "bench", produce))
+	if err != nil {
+		b.Fatalf("Failed to encode request: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoded := sarama.Request{}
+		if err = decoded.Decode(&sarama.RealDecoder{Raw: req}); err != nil {
+			b.Fatalf("Failed to decode request: %v", err)
+		}
+		body := &sarama.ProduceResponse{Version: decoded.Body.APIVersion()}
+		body.AddTopicPartition("bench", 0, sarama.ErrNoError)
+		resp := &sarama.Response{CorrelationID: decoded.CorrelationID, Version: ResponseHeaderVersion, Body: body}
+		if _, err = sarama.Encode(resp, nil); err != nil {
+			b.Fatalf("Failed to encode response: %v", err)
+		}
+	}
+}
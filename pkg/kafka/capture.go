@@ -0,0 +1,155 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"kcore/pkg/logging"
+)
+
+// MaxCaptureFrameBytes is the number of bytes of each request and response dumped by Capture, the rest of larger frames
+// is left out.
+const MaxCaptureFrameBytes = 64 * 1024
+
+// Capture writes the raw frames of selected requests and of their responses as hex dumps, to diagnose clients that
+// don't work with kcore. Capturing stops once maxBytes have been written.
+type Capture struct {
+	mu        sync.Mutex
+	w         io.Writer
+	maxBytes  int64
+	written   int64
+	full      bool
+	apiKeys   map[int16]bool
+	clientIDs map[string]bool
+}
+
+// NewCapture creates a capture writing to w up to maxBytes. It captures every request unless filtered with
+// WithApiKeys or WithClientIDs.
+func NewCapture(w io.Writer, maxBytes int64) *Capture {
+	return &Capture{w: w, maxBytes: maxBytes}
+}
+
+// WithApiKeys only captures the requests with one of the given API keys.
+func (c *Capture) WithApiKeys(keys ...int16) *Capture {
+	c.apiKeys = make(map[int16]bool, len(keys))
+	for _, key := range keys {
+		c.apiKeys[key] = true
+	}
+	return c
+}
+
+// WithClientIDs only captures the requests sent with one of the given client ids.
+func (c *Capture) WithClientIDs(ids ...string) *Capture {
+	c.clientIDs = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		c.clientIDs[id] = true
+	}
+	return c
+}
+
+// Record writes the request and its response if the request is selected. The response may be nil if the request
+// failed.
+func (c *Capture) Record(session *Session, req EncodedRequest, resp EncodedResponse) {
+	header, ok := parseRequestHeader(req)
+	if !ok || (c.apiKeys != nil && !c.apiKeys[header.apiKey]) ||
+		(c.clientIDs != nil && !c.clientIDs[header.clientID]) {
+		return
+	}
+	// Don't pay for the dump once nothing is captured anymore
+	c.mu.Lock()
+	full := c.full
+	c.mu.Unlock()
+	if full {
+		return
+	}
+
+	var b strings.Builder
+	remoteAddr := ""
+	if session.RemoteAddr != nil {
+		remoteAddr = session.RemoteAddr.String()
+	}
+	fmt.Fprintf(
+		&b, "# %s connection %d %s client id %q api key %d version %d correlation id %d\n",
+		time.Now().UTC().Format(time.RFC3339Nano), session.ID, remoteAddr, header.clientID, header.apiKey,
+		header.apiVersion, header.correlationID,
+	)
+	dumpFrame(&b, "> request", req)
+	if resp != nil {
+		dumpFrame(&b, "< response", resp)
+	}
+	b.WriteString("\n")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.full {
+		return
+	}
+	if c.written+int64(b.Len()) > c.maxBytes {
+		c.full = true
+		logging.Module("kafka").Warn(
+			"Capture size limit reached, no more requests are captured", "max bytes", c.maxBytes,
+		)
+		return
+	}
+	n, err := io.WriteString(c.w, b.String())
+	c.written += int64(n)
+	if err != nil {
+		c.full = true
+		logging.Module("kafka").Error("Failed to write capture, no more requests are captured", "error", err)
+	}
+}
+
+// dumpFrame writes the hex dump of the first MaxCaptureFrameBytes of frame, preceded by its size.
+func dumpFrame(b *strings.Builder, name string, frame []byte) {
+	fmt.Fprintf(b, "%s %d bytes\n", name, len(frame))
+	dumped := frame[:min(len(frame), MaxCaptureFrameBytes)]
+	b.WriteString(hex.Dump(dumped))
+	if len(dumped) < len(frame) {
+		fmt.Fprintf(b, "... %d more bytes not captured\n", len(frame)-len(dumped))
+	}
+}
+
+type requestHeader struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+	clientID      string
+}
+
+// parseRequestHeader reads the fields of the request header common to all the versions, without decoding the request.
+func parseRequestHeader(req []byte) (requestHeader, bool) {
+	if len(req) < 10 {
+		return requestHeader{}, false
+	}
+	h := requestHeader{
+		apiKey:        int16(binary.BigEndian.Uint16(req)),
+		apiVersion:    int16(binary.BigEndian.Uint16(req[2:])),
+		correlationID: int32(binary.BigEndian.Uint32(req[4:])),
+	}
+	// The client id is a nullable string, -1 for null
+	if n := int(int16(binary.BigEndian.Uint16(req[8:]))); n > 0 && len(req) >= 10+n {
+		h.clientID = string(req[10 : 10+n])
+	}
+	return h, true
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kafka/kafkatest"
+)
+
+func TestCapture(t *testing.T) {
+	apiVersions := func(clientID string) EncodedRequest {
+		buf, err := kafkatest.EncodeRequest(kafkatest.NewRequest(7, clientID, &sarama.ApiVersionsRequest{Version: 0}))
+		if err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+		return buf
+	}
+	session := NewSession(TestListener, kafkatest.DefaultRemoteAddr)
+
+	tests := []struct {
+		name      string
+		capture   func(*Capture) *Capture
+		clientID  string
+		maxBytes  int64
+		wantEmpty bool
+	}{
+		{"Everything", func(c *Capture) *Capture { return c }, "rdkafka", 1 << 20, false},
+		{
+			"Selected API key", func(c *Capture) *Capture { return c.WithApiKeys(ApiVersionsApiKey) }, "rdkafka",
+			1 << 20, false,
+		},
+		{"Other API key", func(c *Capture) *Capture { return c.WithApiKeys(0, 1) }, "rdkafka", 1 << 20, true},
+		{"Selected client", func(c *Capture) *Capture { return c.WithClientIDs("rdkafka") }, "rdkafka", 1 << 20, false},
+		{"Other client", func(c *Capture) *Capture { return c.WithClientIDs("sarama") }, "rdkafka", 1 << 20, true},
+		{"Size limit", func(c *Capture) *Capture { return c }, "rdkafka", 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				var out strings.Builder
+				capture := tt.capture(NewCapture(&out, tt.maxBytes))
+				capture.Record(session, apiVersions(tt.clientID), EncodedResponse{0, 0, 0, 7})
+
+				if tt.wantEmpty {
+					if out.Len() != 0 {
+						t.Fatalf("Expected nothing to be captured, got:\n%s", out.String())
+					}
+					return
+				}
+				for _, want := range []string{
+					`client id "rdkafka" api key 18 version 0 correlation id 7`, "> request", "< response 4 bytes",
+					"00000000  00 00 00 07",
+				} {
+					if !strings.Contains(out.String(), want) {
+						t.Fatalf("Expected the capture to contain %q, got:\n%s", want, out.String())
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestCaptureLargeFrames(t *testing.T) {
+	var out strings.Builder
+	capture := NewCapture(&out, 1<<20)
+	req, err := kafkatest.EncodeRequest(kafkatest.NewRequest(7, "rdkafka", &sarama.ApiVersionsRequest{Version: 0}))
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	resp := make(EncodedResponse, MaxCaptureFrameBytes+100)
+	capture.Record(NewSession(TestListener, kafkatest.DefaultRemoteAddr), req, resp)
+
+	want := "< response " + strconv.Itoa(len(resp)) + " bytes"
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), "... 100 more bytes not captured") {
+		t.Fatalf("Expected the response to be truncated, got %d bytes of capture", out.Len())
+	}
+	if out.Len() > 5*MaxCaptureFrameBytes {
+		t.Fatalf("Expected the dump to be capped, got %d bytes", out.Len())
+	}
+}
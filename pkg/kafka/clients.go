@@ -0,0 +1,252 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kcore/pkg/logging"
+)
+
+// ClientInfo describes a connected client, as listed by the admin API.
+type ClientInfo struct {
+	ConnectionID    uint64    `json:"connection_id"`
+	RemoteAddress   string    `json:"remote_address"`
+	Listener        string    `json:"listener"`
+	Principal       string    `json:"principal"`
+	ClientID        string    `json:"client_id"`
+	SoftwareName    string    `json:"software_name"`
+	SoftwareVersion string    `json:"software_version"`
+	Priority        string    `json:"priority"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	// LastActivity is when the last request was received, or when the client connected if it sent none.
+	LastActivity time.Time `json:"last_activity"`
+	// Requests counts the requests received on the connection by API key.
+	Requests map[int16]uint64 `json:"requests"`
+}
+
+// ClientRegistry keeps track of the clients connected to the broker and of the software they run, so that operators
+// can find the clients to upgrade before deprecating an old protocol version, or the client hammering the broker.
+type ClientRegistry struct {
+	mu      sync.Mutex
+	clients map[*Session]*client
+	// minVersions maps lower case client software names to the minimum version that does not log a warning.
+	minVersions map[string]string
+}
+
+// client is a registered connection.
+type client struct {
+	info ClientInfo
+	conn io.Closer
+}
+
+// NewClientRegistry creates an empty client registry.
+func NewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{
+		clients: make(map[*Session]*client),
+	}
+}
+
+// WithMinimumVersions makes the registry log a warning when a client reports a software version lower than the
+// minimum configured for its software name. See ParseMinimumClientVersions.
+func (r *ClientRegistry) WithMinimumVersions(minVersions map[string]string) *ClientRegistry {
+	r.minVersions = minVersions
+	return r
+}
+
+// Register adds the client of a new connection to the registry. conn is closed when the connection is killed through
+// Close, it may be nil if the connection can't be killed.
+func (r *ClientRegistry) Register(session *Session, conn io.Closer) {
+	info := clientInfo(session)
+	info.ConnectedAt = time.Now()
+	info.LastActivity = info.ConnectedAt
+	info.Requests = make(map[int16]uint64)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[session] = &client{info: info, conn: conn}
+}
+
+// Update records what the client of a registered connection told about itself, e.g. in an ApiVersions request. It
+// must be called by the goroutine handling the connection.
+func (r *ClientRegistry) Update(session *Session) {
+	info := clientInfo(session)
+	r.mu.Lock()
+	c, ok := r.clients[session]
+	var previous ClientInfo
+	if ok {
+		previous = c.info
+		info.ConnectedAt = previous.ConnectedAt
+		info.LastActivity = previous.LastActivity
+		info.Requests = previous.Requests
+		c.info = info
+	}
+	r.mu.Unlock()
+	if !ok || (previous.SoftwareName == info.SoftwareName && previous.SoftwareVersion == info.SoftwareVersion) {
+		return
+	}
+	minVersion, ok := r.minVersions[strings.ToLower(info.SoftwareName)]
+	if ok && compareVersions(info.SoftwareVersion, minVersion) < 0 {
+		logging.Module("kafka").Warn(
+			"Client software version is lower than the minimum supported version", "session", session,
+			"minimum version", minVersion,
+		)
+	}
+}
+
+// RecordRequest counts a request received from the client of a registered connection.
+func (r *ClientRegistry) RecordRequest(session *Session, apiKey int16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.clients[session]; ok {
+		c.info.LastActivity = time.Now()
+		c.info.Requests[apiKey]++
+	}
+}
+
+// Unregister removes the client of a closed connection from the registry.
+func (r *ClientRegistry) Unregister(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, session)
+}
+
+// Close kills the connection with the given ID. It returns false if there is no such connection.
+func (r *ClientRegistry) Close(connectionID uint64) (bool, error) {
+	r.mu.Lock()
+	var found *client
+	for s, c := range r.clients {
+		if s.ID == connectionID {
+			found = c
+			break
+		}
+	}
+	var info ClientInfo
+	if found != nil {
+		// The session is modified by the goroutine handling the connection, only its copy is safe to read here
+		info = found.info
+	}
+	r.mu.Unlock()
+	if found == nil {
+		return false, nil
+	}
+	if found.conn == nil {
+		return true, fmt.Errorf("connection %d can't be closed", connectionID)
+	}
+	logging.Module("kafka").Info(
+		"Closing connection", "connection id", info.ConnectionID, "remote address", info.RemoteAddress,
+		"principal", info.Principal, "client id", info.ClientID,
+	)
+	// The handler of the connection stops waiting, fails to read its next request and unregisters the client
+	return true, found.conn.Close()
+}
+
+// Clients returns the connected clients, oldest connection first.
+func (r *ClientRegistry) Clients() []ClientInfo {
+	r.mu.Lock()
+	clients := make([]ClientInfo, 0, len(r.clients))
+	for _, c := range r.clients {
+		info := c.info
+		info.Requests = make(map[int16]uint64, len(c.info.Requests))
+		for apiKey, count := range c.info.Requests {
+			info.Requests[apiKey] = count
+		}
+		clients = append(clients, info)
+	}
+	r.mu.Unlock()
+	sort.Slice(
+		clients, func(i, j int) bool {
+			return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+		},
+	)
+	return clients
+}
+
+func clientInfo(session *Session) ClientInfo {
+	info := ClientInfo{
+		ConnectionID:    session.ID,
+		Listener:        session.Listener.Name,
+		Principal:       session.Principal,
+		ClientID:        session.ClientID,
+		SoftwareName:    session.ClientSoftwareName,
+		SoftwareVersion: session.ClientSoftwareVersion,
+		Priority:        session.Priority.String(),
+	}
+	if session.RemoteAddr != nil {
+		info.RemoteAddress = session.RemoteAddr.String()
+	}
+	return info
+}
+
+// ParseMinimumClientVersions parses a comma separated list of NAME:VERSION pairs, e.g.
+// "apache-kafka-java:3.0.0,librdkafka:2.0.0". Names are matched case insensitively against the client software names.
+func ParseMinimumClientVersions(s string) (map[string]string, error) {
+	minVersions := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, version, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || version == "" {
+			return nil, fmt.Errorf("invalid minimum client version %q, expected NAME:VERSION", entry)
+		}
+		minVersions[strings.ToLower(name)] = version
+	}
+	return minVersions, nil
+}
+
+// compareVersions compares two dotted versions number by number, e.g. 2.10.0 is greater than 2.9.1. Pre-release and
+// build suffixes are ignored.
+func compareVersions(a, b string) int {
+	as, bs := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionNumbers(version string) []int {
+	version, _, _ = strings.Cut(version, "-")
+	version, _, _ = strings.Cut(version, "+")
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
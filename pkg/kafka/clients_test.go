@@ -0,0 +1,157 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestClientRegistry(t *testing.T) {
+	clients := NewClientRegistry().WithMinimumVersions(map[string]string{"librdkafka": "2.0.0"})
+	first := NewSession(TestListener, nil)
+	second := NewSession(TestListener, nil)
+	clients.Register(first, nil)
+	clients.Register(second, nil)
+
+	second.ClientSoftwareName = "librdkafka"
+	second.ClientSoftwareVersion = "1.9.2"
+	clients.Update(second)
+	got := clients.Clients()
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(got))
+	}
+	if got[1].SoftwareName != "librdkafka" || got[1].SoftwareVersion != "1.9.2" || got[1].Listener != TestListener.Name {
+		t.Fatalf("Unexpected client info: %+v", got[1])
+	}
+
+	clients.Unregister(first)
+	clients.Unregister(second)
+	// Updates racing with the connection being closed must not register the client again
+	clients.Update(second)
+	if got = clients.Clients(); len(got) != 0 {
+		t.Fatalf("Expected no clients, got %+v", got)
+	}
+}
+
+func TestParseMinimumClientVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"Empty", "", map[string]string{}, false},
+		{
+			"Several clients", "apache-kafka-java:3.0.0, LIBRDKAFKA:2.0.0",
+			map[string]string{"apache-kafka-java": "3.0.0", "librdkafka": "2.0.0"}, false,
+		},
+		{"Missing version", "librdkafka", nil, true},
+		{"Empty version", "librdkafka:", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got, err := ParseMinimumClientVersions(tt.s)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseMinimumClientVersions() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("ParseMinimumClientVersions() got = %v, want %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_compareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.0.0", "2.0.0", 0},
+		{"2.10.0", "2.9.1", 1},
+		{"1.9.2", "2.0.0", -1},
+		{"3.6", "3.6.0", 0},
+		{"3.7.0-SNAPSHOT", "3.7.0", 0},
+		{"unknown", "1.0.0", -1},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.a+" vs "+tt.b, func(t *testing.T) {
+				if got := compareVersions(tt.a, tt.b); got != tt.want {
+					t.Fatalf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func TestClientRegistryRequestsAndClose(t *testing.T) {
+	clients := NewClientRegistry()
+	session := NewSession(TestListener, nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	clients.Register(session, server)
+	clients.RecordRequest(session, ApiVersionsApiKey)
+	clients.RecordRequest(session, ApiVersionsApiKey)
+
+	got := clients.Clients()
+	if len(got) != 1 || got[0].Requests[ApiVersionsApiKey] != 2 || got[0].LastActivity.Before(got[0].ConnectedAt) {
+		t.Fatalf("Unexpected client info: %+v", got)
+	}
+	// The returned counts are a copy
+	got[0].Requests[ApiVersionsApiKey] = 0
+	if clients.Clients()[0].Requests[ApiVersionsApiKey] != 2 {
+		t.Fatalf("Expected the request counts not to be shared")
+	}
+
+	if found, _ := clients.Close(session.ID + 1); found {
+		t.Fatalf("Expected no connection with ID %d", session.ID+1)
+	}
+	if found, err := clients.Close(session.ID); !found || err != nil {
+		t.Fatalf("Failed to close connection: found %v, error %v", found, err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected the connection to be closed")
+	}
+}
+
+// TestClientRegistryCloseWhileHandling closes a connection while its goroutine keeps updating the session, go test
+// -race reports it if Close reads the session.
+func TestClientRegistryCloseWhileHandling(t *testing.T) {
+	clients := NewClientRegistry()
+	session := NewSession(TestListener, nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	clients.Register(session, server)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			session.ClientID = "client-" + strconv.Itoa(i)
+			clients.RecordRequest(session, ApiVersionsApiKey)
+		}
+	}()
+	if found, err := clients.Close(session.ID); !found || err != nil {
+		t.Fatalf("Failed to close connection: found %v, error %v", found, err)
+	}
+	<-done
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultRequestTimeout matches the default request.timeout.ms of the Kafka clients.
+	DefaultRequestTimeout = 30 * time.Second
+	// DefaultMaxRequestSize matches the default socket.request.max.bytes of Kafka brokers.
+	DefaultMaxRequestSize = 100 * 1024 * 1024
+)
+
+// Config holds the settings of the Kafka API.
+type Config struct {
+	// RequestTimeout is the maximum time spent handling a request. Handlers receive a context with this deadline and
+	// requests that exceed it are answered with a REQUEST_TIMED_OUT error. 0 disables the timeout.
+	RequestTimeout time.Duration
+	// MaxRequestSize is the maximum size of a request. Connections sending larger requests are closed before the
+	// request is read. 0 disables the limit.
+	MaxRequestSize int
+	// QueuedMaxRequestBytes is the capacity of the MemoryPool shared by all the connections. 0 disables the limit.
+	QueuedMaxRequestBytes int64
+	// Logger is the logger of the connections, nil uses slog.Default(). Embedders can set it to send the logs to their
+	// own slog.Handler. Connection and request logs include the connection id, remote address, principal and
+	// correlation id.
+	Logger *slog.Logger
+	// Capture writes the frames of selected requests and responses for debugging, nil disables it.
+	Capture *Capture
+	// PrincipalBuilder builds the principal of the clients, nil uses DefaultPrincipalBuilder.
+	PrincipalBuilder PrincipalBuilder
+	// HighPriorityPrincipals are the principals whose connections have a high priority, whatever their listener.
+	HighPriorityPrincipals []string
+	// LoadShedder pauses the heaviest connections when requests are queued for too long, nil disables it.
+	LoadShedder *LoadShedder
+}
+
+// DefaultConfig returns the default settings of the Kafka API.
+func DefaultConfig() Config {
+	return Config{
+		RequestTimeout: DefaultRequestTimeout,
+		MaxRequestSize: DefaultMaxRequestSize,
+	}
+}
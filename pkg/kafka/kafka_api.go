@@ -17,11 +17,14 @@ limitations under the License.
 package kafka
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log/slog"
 
 	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kerrors"
+	"kcore/pkg/logging"
 )
 
 type EncodedRequest []byte
@@ -30,12 +33,17 @@ type EncodedResponse []byte
 // RequestHandler is an interface for handling Kafka requests.
 // A single handler can handle multiple request types (i.e. API keys).
 type RequestHandler interface {
-	// Handle handles the Kafka request and returns the response.
-	Handle(encodedReq EncodedRequest) (EncodedResponse, error)
+	// Handle handles the Kafka request and returns the response. The context carries the Session of the connection
+	// the request was received on.
+	Handle(ctx context.Context, encodedReq EncodedRequest) (EncodedResponse, error)
 }
 
+// KafkaApi handles the decoded Kafka requests. The context passed to the handlers is cancelled when the request times
+// out or the connection is closed, handlers must then stop their work and return: the request is answered without
+// waiting for them.
 type KafkaApi interface {
 	HandleApiVersions(
+		ctx context.Context,
 		correlationId int32,
 		clientId string,
 		request sarama.ApiVersionsRequest,
@@ -43,57 +51,107 @@ type KafkaApi interface {
 }
 
 type kafkaApi struct {
+	config  Config
+	clients *ClientRegistry
 }
 
-func NewKafkaApi() RequestHandler {
-	return &kafkaApi{}
+// NewKafkaApi creates the handler of the Kafka requests. What clients tell about themselves is recorded in clients.
+func NewKafkaApi(config Config, clients *ClientRegistry) RequestHandler {
+	return &kafkaApi{
+		config:  config,
+		clients: clients,
+	}
 }
 
-func (k *kafkaApi) Handle(encodedRequest EncodedRequest) (EncodedResponse, error) {
+func (k *kafkaApi) Handle(ctx context.Context, encodedRequest EncodedRequest) (EncodedResponse, error) {
+	session, ok := SessionFromContext(ctx)
+	if !ok {
+		session = NewSession(Listener{}, nil)
+	}
+
+	logger := logging.FromContext(ctx)
+
 	// Parse the request
 	req := sarama.Request{}
 	err := req.Decode(&sarama.RealDecoder{Raw: encodedRequest})
 	if err != nil {
-		slog.Error("Failed to decode request", "error", err)
-		return nil, fmt.Errorf("failed to decode request: %w", err)
+		err = kerrors.Wrap(sarama.ErrInvalidRequest, err, "failed to decode request")
+		logger.Error("Failed to decode request", kerrors.Attr(err))
+		return nil, err
 	}
-	slog.Debug(
-		"Decoded request. Dispatching...", "client id", req.ClientID, "correlation id", req.CorrelationID,
-		"api key",
-		req.Body.APIKey(), "api version", req.Body.APIVersion(), "body", req.Body,
+	session.ClientID = req.ClientID
+	k.clients.RecordRequest(session, req.Body.APIKey())
+	logger = logger.With("correlation id", req.CorrelationID, "client id", req.ClientID)
+	ctx = logging.NewContext(ctx, logger)
+	logger.Debug(
+		"Decoded request. Dispatching...", "api key", req.Body.APIKey(), "api version", req.Body.APIVersion(),
+		"body", req.Body,
 	)
 
-	resp, err := k.dispatch(&req)
+	if k.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.config.RequestTimeout)
+		defer cancel()
+	}
+	resp, err := k.dispatch(ctx, session, &req)
 	if err != nil {
-		slog.Error("Failed to dispatch request", "error", err)
-		return nil, fmt.Errorf("failed to dispatch request: %w", err)
+		logger.Error("Failed to dispatch request", kerrors.Attr(err))
+		return nil, kerrors.Wrap(kerrors.Code(err), err, "failed to dispatch request")
 	}
 
 	encodedResp, err := sarama.Encode(resp, nil)
 	if err != nil {
-		slog.Error("Failed to encode response", err)
-		return nil, fmt.Errorf("failed to encode response: %w", err)
+		logger.Error("Failed to encode response", kerrors.Attr(err))
+		return nil, kerrors.Wrap(sarama.ErrUnknown, err, "failed to encode response")
 	}
 	return encodedResp, nil
 }
 
-func (k *kafkaApi) dispatch(req *sarama.Request) (*sarama.Response, error) {
+func (k *kafkaApi) dispatch(ctx context.Context, session *Session, req *sarama.Request) (*sarama.Response, error) {
 	var responseBody sarama.ProtocolBody
-	var err error
+	logger := logging.FromContext(ctx)
 
 	switch req.Body.APIKey() {
 	case ApiVersionsApiKey:
 		apiVersionsReq, ok := req.Body.(*sarama.ApiVersionsRequest)
 		if !ok {
-			return nil, errors.New("invalid request type")
+			return nil, kerrors.New(
+				sarama.ErrInvalidRequest, fmt.Sprintf("invalid ApiVersions request type %T", req.Body),
+			)
+		}
+		logger.Debug("Dispatching request", "api key", req.Body.APIKey(), "ApiVersions request", apiVersionsReq)
+		apiVersionsResp, err := callWithContext(
+			ctx, func() (*sarama.ApiVersionsResponse, error) {
+				return k.HandleApiVersions(ctx, req.CorrelationID, req.ClientID, *apiVersionsReq)
+			},
+		)
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Warn("ApiVersions request timed out")
+			apiVersionsResp, err = &sarama.ApiVersionsResponse{
+				Version:   apiVersionsReq.Version,
+				ErrorCode: int16(kerrors.Code(err)),
+			}, nil
 		}
-		slog.Debug("Dispatching request", "api key", req.Body.APIKey(), "ApiVersions request", apiVersionsReq)
-		responseBody, err = k.HandleApiVersions(req.CorrelationID, req.ClientID, *apiVersionsReq)
 		if err != nil {
-			return nil, fmt.Errorf("error while handling ApiVersions request: %w", err)
+			return nil, kerrors.Wrap(kerrors.Code(err), err, "error while handling ApiVersions request")
+		}
+		if apiVersionsReq.Version > ApiVersionsMaxVersion {
+			// Clients newer than the broker can always read a v0 response, they retry with the highest version it
+			// lists.
+			logger.Debug("Unsupported ApiVersions version, answering with v0", "api version", apiVersionsReq.Version)
+			apiVersionsResp.Version = 0
+			apiVersionsResp.ErrorCode = int16(sarama.ErrUnsupportedVersion)
 		}
+		responseBody = apiVersionsResp
+		if apiVersionsReq.Version >= 3 {
+			session.ClientSoftwareName = apiVersionsReq.ClientSoftwareName
+			session.ClientSoftwareVersion = apiVersionsReq.ClientSoftwareVersion
+		}
+		k.clients.Update(session)
 	default:
-		return nil, errors.New("no handler found for request")
+		return nil, kerrors.New(
+			sarama.ErrUnsupportedVersion, fmt.Sprintf("no handler found for api key %d", req.Body.APIKey()),
+		)
 	}
 
 	return &sarama.Response{
@@ -104,6 +162,7 @@ func (k *kafkaApi) dispatch(req *sarama.Request) (*sarama.Response, error) {
 }
 
 func (k *kafkaApi) HandleApiVersions(
+	ctx context.Context,
 	correlationId int32,
 	clientId string,
 	request sarama.ApiVersionsRequest,
@@ -114,12 +173,34 @@ func (k *kafkaApi) HandleApiVersions(
 		ApiKeys: []sarama.ApiVersionsResponseKey{
 			{
 				ApiKey:     ApiVersionsApiKey,
-				MinVersion: ApiVersionsRequestVersion,
-				MaxVersion: ApiVersionsRequestVersion,
+				MinVersion: ApiVersionsMinVersion,
+				MaxVersion: ApiVersionsMaxVersion,
 			},
 		},
-		Version:   ApiVersionsRequestVersion,
+		Version:   request.Version,
 		ErrorCode: 0,
 	}, nil
 
 }
+
+// callWithContext calls fn and waits for it to return or for ctx to be done, whichever happens first. A handler stuck
+// on an operation that ignores the context is left behind instead of blocking the connection forever: fn keeps running
+// in its goroutine until it returns, and its result is dropped. fn must watch ctx for the timeout to stop its work.
+func callWithContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
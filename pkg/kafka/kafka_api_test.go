@@ -17,15 +17,20 @@ limitations under the License.
 package kafka
 
 import (
-	"io"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
-	"net"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kafka/kafkatest"
+	"kcore/pkg/kerrors"
 )
 
 const (
@@ -33,6 +38,8 @@ const (
 	ControllerId = 0
 )
 
+var TestListener = Listener{Name: "PLAINTEXT", SecurityProtocol: Plaintext, Host: "127.0.0.1", Port: 9092}
+
 func TestMain(m *testing.M) {
 	h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: false, Level: slog.LevelInfo})
 	slog.SetDefault(slog.New(h))
@@ -40,58 +47,113 @@ func TestMain(m *testing.M) {
 }
 
 func TestAPIVersionsRequest(t *testing.T) {
-	apiVersionRequest := sarama.ApiVersionsRequest{
-		Version:               3,
-		ClientSoftwareName:    "sarama",
-		ClientSoftwareVersion: "1.27.0",
-	}
-	request := sarama.Request{
-		CorrelationID: 1,
-		ClientID:      "sarama",
-		Body:          &apiVersionRequest,
-	}
-	expectedResp := sarama.Response{
-		Version:     ResponseHeaderVersion,
-		Body:        &sarama.ApiVersionsResponse{},
-		BodyVersion: apiVersionRequest.Version,
-	}
-
-	conn := NewMockConnection().WithRequest(request).ExpectResponse(
-		expectedResp.Version, expectedResp.Body, expectedResp.BodyVersion,
+	request := kafkatest.NewRequest(
+		1, "sarama", &sarama.ApiVersionsRequest{
+			Version:               3,
+			ClientSoftwareName:    "sarama",
+			ClientSoftwareVersion: "1.27.0",
+		},
+	)
+	conn := kafkatest.NewConn().WithRequest(request).ExpectResponse(
+		ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 3,
 	)
 
-	handler := NewKafkaConnectionHandler(NewKafkaApi(ClusterID, ControllerId))
+	handler := NewKafkaConnectionHandler(
+		TestListener, DefaultConfig(), NewMemoryPool(0), NewClientRegistry(),
+		NewKafkaApi(DefaultConfig(), NewClientRegistry()),
+	)
 
 	handler.HandleConnection(conn)
 
-	resp, err := conn.ReadResponse()
+	resp := conn.RequireResponse(t)
+	apiVersionsResponse, ok := resp.Body.(*sarama.ApiVersionsResponse)
+	if !ok {
+		t.Fatalf("Expected an ApiVersions response, got %T", resp.Body)
+	}
 
-	if err != nil {
-		t.Fatalf("Failed to read response: %v", err)
+	if apiVersionsResponse.ErrorCode != 0 {
+		t.Fatalf("Expected error code to be 0, got %d", apiVersionsResponse.ErrorCode)
 	}
 
-	if resp == nil {
-		t.Fatalf("Expected response to be non-nil")
-	} else if resp.CorrelationID != request.CorrelationID {
-		t.Fatalf("Expected correlation id to be %d, got %d", request.CorrelationID, resp.CorrelationID)
+	if len(apiVersionsResponse.ApiKeys) == 0 {
+		t.Fatalf("Expected api keys to be non-empty")
 	}
+	if !conn.Closed() {
+		t.Fatalf("Expected the connection to be closed once the client is done")
+	}
+}
 
-	if resp.Body == nil {
-		t.Fatalf("Expected response body to be non-nil")
+// TestPipelinedRequests tests that requests sent without waiting for the previous responses are all answered, in order
+func TestPipelinedRequests(t *testing.T) {
+	conn := kafkatest.NewConn()
+	for i := int32(1); i <= 3; i++ {
+		conn.WithRequest(kafkatest.NewRequest(i, "rdkafka", &sarama.ApiVersionsRequest{Version: 0})).
+			ExpectResponse(ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 0)
 	}
 
-	apiVersionsResponse := resp.Body.(*sarama.ApiVersionsResponse)
+	handler := NewKafkaConnectionHandler(
+		TestListener, DefaultConfig(), NewMemoryPool(0), NewClientRegistry(),
+		NewKafkaApi(DefaultConfig(), NewClientRegistry()),
+	)
+	handler.HandleConnection(conn)
 
-	if err != nil {
-		t.Fatalf("Failed to decode response: %v", err)
+	for i := 0; i < 3; i++ {
+		conn.RequireResponse(t)
 	}
+}
 
-	if apiVersionsResponse.ErrorCode != 0 {
-		t.Fatalf("Expected error code to be 0, got %d", apiVersionsResponse.ErrorCode)
+// TestZeroConfig tests that a zero Config, as built by an embedder, neither limits the size of the requests nor times
+// them out
+func TestZeroConfig(t *testing.T) {
+	conn := kafkatest.NewConn().
+		WithRequest(kafkatest.NewRequest(1, "rdkafka", &sarama.ApiVersionsRequest{Version: 0})).
+		ExpectResponse(ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 0)
+
+	handler := NewKafkaConnectionHandler(
+		TestListener, Config{}, NewMemoryPool(0), NewClientRegistry(), NewKafkaApi(Config{}, NewClientRegistry()),
+	)
+	handler.HandleConnection(conn)
+
+	resp, ok := conn.RequireResponse(t).Body.(*sarama.ApiVersionsResponse)
+	if !ok || resp.ErrorCode != 0 {
+		t.Fatalf("Expected a successful ApiVersions response, got %+v", resp)
 	}
+}
 
-	if len(apiVersionsResponse.ApiKeys) == 0 {
-		t.Fatalf("Expected api keys to be non-empty")
+// TestConnectionLogger tests that the logs of a connection go to the configured logger with the attributes of the
+// connection and of the request
+func TestConnectionLogger(t *testing.T) {
+	var logs bytes.Buffer
+	config := DefaultConfig()
+	config.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	conn := kafkatest.NewConn().WithRequest(kafkatest.NewRequest(42, "logged-client", &sarama.ApiVersionsRequest{})).
+		ExpectResponse(ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 0)
+
+	handler := NewKafkaConnectionHandler(
+		TestListener, config, NewMemoryPool(0), NewClientRegistry(), NewKafkaApi(config, NewClientRegistry()),
+	)
+	handler.HandleConnection(conn)
+	conn.RequireResponse(t)
+
+	var dispatched bool
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Failed to decode log line %s: %v", line, err)
+		}
+		if record["connection id"] == nil || record["remote address"] != kafkatest.DefaultRemoteAddr.String() ||
+			record["principal"] != AnonymousPrincipal {
+			t.Fatalf("Expected every log line to include the connection attributes, got %s", line)
+		}
+		if record["msg"] == "Dispatching request" {
+			dispatched = true
+			if record["correlation id"] != float64(42) || record["client id"] != "logged-client" {
+				t.Fatalf("Expected request logs to include the request attributes, got %s", line)
+			}
+		}
+	}
+	if !dispatched {
+		t.Fatalf("Expected the request to be logged, got %s", logs.String())
 	}
 }
 
@@ -124,15 +186,24 @@ func Test_kafkaApi_HandleApiVersions(t *testing.T) {
 				},
 			},
 			want: &sarama.ApiVersionsResponse{
-
+				Version: 3,
+				ApiKeys: []sarama.ApiVersionsResponseKey{
+					{
+						ApiKey:     ApiVersionsApiKey,
+						MinVersion: ApiVersionsMinVersion,
+						MaxVersion: ApiVersionsMaxVersion,
+					},
+				},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(
 			tt.name, func(t *testing.T) {
-				k := &kafkaApi{}
-				got, err := k.HandleApiVersions(tt.args.correlationId, tt.args.clientId, tt.args.request)
+				k := &kafkaApi{config: DefaultConfig(), clients: NewClientRegistry()}
+				got, err := k.HandleApiVersions(
+					context.Background(), tt.args.correlationId, tt.args.clientId, tt.args.request,
+				)
 				if (err != nil) != tt.wantErr {
 					t.Errorf("HandleApiVersions() error = %v, wantErr %v", err, tt.wantErr)
 					return
@@ -145,138 +216,146 @@ func Test_kafkaApi_HandleApiVersions(t *testing.T) {
 	}
 }
 
-// MockConnection is a mock kafka client connection for testing. It allows you to set Kafka requests in order and
-// read the responses written to the connection in the same order.
-type MockConnection struct {
-	out  [][]byte
-	in   [][]byte
-	reqs []*ReqRespPair
-}
-
-type ReqRespPair struct {
-	Request             *sarama.Request
-	ResponseVresion     int16
-	ResponseBodyType    reflect.Type
-	ResponseBodyVersion int16
-}
-
-// NewMockConnection creates a new mock connection.
-func NewMockConnection() *MockConnection {
-	return &MockConnection{}
-}
-
-// Read is expected to be called by the Kafka connection handler to read the request from the client.
-//
-// For testing purposes, we will return the request set by the test case in the order they were set using WithRequest.
-func (m *MockConnection) Read(b []byte) (n int, err error) {
-	if len(m.out) == 0 {
-		return 0, io.EOF
+// Test_kafkaApi_HandleApiVersionsFallback tests that every supported ApiVersions version is answered with the same
+// version, and that newer versions are answered with a v0 UNSUPPORTED_VERSION response listing the supported versions.
+func Test_kafkaApi_HandleApiVersionsFallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		version       int16
+		wantVersion   int16
+		wantErrorCode sarama.KError
+	}{
+		{"v0 used by librdkafka before knowing the broker version", 0, 0, sarama.ErrNoError},
+		{"v1", 1, 1, sarama.ErrNoError},
+		{"v2", 2, 2, sarama.ErrNoError},
+		{"v3", 3, 3, sarama.ErrNoError},
+		{"Newer than the broker", ApiVersionsMaxVersion + 1, 0, sarama.ErrUnsupportedVersion},
 	}
-	copy(b, m.out[0])
-	m.out = m.out[1:]
-	return len(b), nil
-}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				request := sarama.Request{
+					CorrelationID: 7,
+					ClientID:      "rdkafka",
+					Body:          &sarama.ApiVersionsRequest{Version: tt.version},
+				}
+				buf, err := kafkatest.EncodeRequest(request)
+				if err != nil {
+					t.Fatalf("Failed to encode request: %v", err)
+				}
+				k := &kafkaApi{config: DefaultConfig(), clients: NewClientRegistry()}
+				encoded, err := k.Handle(context.Background(), buf)
+				if err != nil {
+					t.Fatalf("Failed to handle request: %v", err)
+				}
 
-// Write is expected to be called by the Kafka connection handler to write the response to the client.
-//
-// For testing purposes, we will store the response in the connection so that it can be read by the test case by
-// calling ReadResponse.
-func (m *MockConnection) Write(b []byte) (n int, err error) {
-	if m.in == nil {
-		m.in = make([][]byte, 0)
+				body := &sarama.ApiVersionsResponse{}
+				resp := &sarama.Response{Body: body, BodyVersion: tt.wantVersion}
+				if err = sarama.VersionedDecode(encoded, resp, ResponseHeaderVersion, nil); err != nil {
+					t.Fatalf("Failed to decode a v%d response: %v", tt.wantVersion, err)
+				}
+				if resp.CorrelationID != request.CorrelationID {
+					t.Fatalf("Expected correlation id %d, got %d", request.CorrelationID, resp.CorrelationID)
+				}
+				if body.ErrorCode != int16(tt.wantErrorCode) {
+					t.Fatalf("Expected error code %d, got %d", tt.wantErrorCode, body.ErrorCode)
+				}
+				if len(body.ApiKeys) != 1 || body.ApiKeys[0].MaxVersion != ApiVersionsMaxVersion {
+					t.Fatalf("Expected the supported ApiVersions versions to be listed, got %+v", body.ApiKeys)
+				}
+			},
+		)
 	}
-	m.in = append(m.in, b)
-	return len(b), nil
-}
-
-func (m *MockConnection) Close() error {
-	return nil
-}
-
-func (m *MockConnection) LocalAddr() net.Addr {
-	return nil
-}
-
-func (m *MockConnection) RemoteAddr() net.Addr {
-	return nil
 }
 
-func (m *MockConnection) SetDeadline(t time.Time) error {
-	return nil
-}
-
-func (m *MockConnection) SetReadDeadline(t time.Time) error {
-	return nil
-}
-
-func (m *MockConnection) SetWriteDeadline(t time.Time) error {
-	return nil
-}
-
-// WithRequest sets the request to be sent by the client. The request will be encoded and stored to be later read by
-// the Kafka connection handler.
-func (m *MockConnection) WithRequest(request sarama.Request) *MockConnection {
-	if m.reqs == nil {
-		m.reqs = make([]*ReqRespPair, 0)
+func Test_kafkaApi_HandleRecordsClientSoftware(t *testing.T) {
+	request := sarama.Request{
+		CorrelationID: 1,
+		ClientID:      "kcore-client",
+		Body: &sarama.ApiVersionsRequest{
+			Version:               3,
+			ClientSoftwareName:    "kcore",
+			ClientSoftwareVersion: "1.0.0",
+		},
 	}
-	m.reqs = append(m.reqs, &ReqRespPair{Request: &request})
-
-	buf, err := sarama.Encode(&request, nil)
-
+	buf, err := kafkatest.EncodeRequest(request)
 	if err != nil {
-		return nil
+		t.Fatalf("Failed to encode request: %v", err)
 	}
-	if len(m.out) == 0 {
-		m.out = make([][]byte, 0)
+
+	session := NewSession(Listener{}, nil)
+	clients := NewClientRegistry()
+	clients.Register(session, nil)
+	k := &kafkaApi{config: DefaultConfig(), clients: clients}
+	if _, err = k.Handle(NewSessionContext(context.Background(), session), buf); err != nil {
+		t.Fatalf("Failed to handle request: %v", err)
 	}
 
-	m.out = append(m.out, buf[:4])
-	m.out = append(m.out, buf[4:])
-	return m
+	if session.ClientID != "kcore-client" {
+		t.Errorf("Expected client id to be %q, got %q", "kcore-client", session.ClientID)
+	}
+	if session.ClientSoftwareName != "kcore" || session.ClientSoftwareVersion != "1.0.0" {
+		t.Errorf(
+			"Expected client software to be kcore 1.0.0, got %s %s", session.ClientSoftwareName,
+			session.ClientSoftwareVersion,
+		)
+	}
+	if session.Principal != AnonymousPrincipal {
+		t.Errorf("Expected principal to be %q, got %q", AnonymousPrincipal, session.Principal)
+	}
+	if got := clients.Clients(); len(got) != 1 || got[0].SoftwareName != "kcore" || got[0].SoftwareVersion != "1.0.0" {
+		t.Errorf("Expected the registry to list kcore 1.0.0, got %+v", got)
+	}
 }
 
-// ExpectResponse sets the response expected for the request set by the test case using WithRequest. The response will be
-// written to the connection by the Kafka connection handler.
-//
-// If no request has been set using WithRequest, this function will panic.
-func (m *MockConnection) ExpectResponse(
-	responseVersion int16,
-	responseBody sarama.ProtocolBody,
-	bodyVersion int16,
-) *MockConnection {
-	if len(m.reqs) == 0 {
-		panic("no request to respond to, call WithRequest first")
+// Test_kafkaApi_HandleErrorCodes tests that the errors returned by Handle carry the Kafka error code of the failure
+func Test_kafkaApi_HandleErrorCodes(t *testing.T) {
+	unhandled, err := kafkatest.EncodeRequest(kafkatest.NewRequest(1, "rdkafka", &sarama.MetadataRequest{Version: 1}))
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	tests := []struct {
+		name     string
+		req      EncodedRequest
+		wantCode sarama.KError
+	}{
+		{"Malformed request", EncodedRequest{0, 18, 0}, sarama.ErrInvalidRequest},
+		{"Unhandled api key", unhandled, sarama.ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				_, err := NewKafkaApi(DefaultConfig(), NewClientRegistry()).Handle(context.Background(), tt.req)
+				if got := kerrors.Code(err); got != tt.wantCode {
+					t.Fatalf("Expected error code %d, got %d: %v", tt.wantCode, got, err)
+				}
+			},
+		)
 	}
-
-	m.reqs[0].ResponseVresion = responseVersion
-	m.reqs[0].ResponseBodyType = reflect.TypeOf(responseBody).Elem()
-	m.reqs[0].ResponseBodyVersion = bodyVersion
-
-	return m
 }
 
-// ReadResponse reads the response written to the connection by the Kafka connection handler. Responses are read in the
-// order they were set by the test case using WithRequest and
-func (m *MockConnection) ReadResponse() (*sarama.Response, error) {
-	resp := &sarama.Response{}
-	orig := reflect.New(m.reqs[0].ResponseBodyType).Elem()
-	orig.FieldByName("Version").SetInt(int64(m.reqs[0].ResponseVresion))
-	resp.Body = (orig.Addr().Interface()).(sarama.ProtocolBody)
-	resp.BodyVersion = m.reqs[0].ResponseBodyVersion
-
-	m.reqs = m.reqs[1:]
+func Test_callWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stuck := make(chan struct{})
+	defer close(stuck)
 
-	if len(m.in) == 0 {
-		return nil, nil
+	_, err := callWithContext(
+		ctx, func() (int, error) {
+			<-stuck
+			return 0, nil
+		},
+	)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a stuck handler to time out, got %v", err)
 	}
 
-	buf := m.in[0]
-	m.in = m.in[1:]
-
-	err := sarama.VersionedDecode(buf, resp, ResponseHeaderVersion, nil)
-	if err != nil {
-		return nil, err
+	got, err := callWithContext(
+		context.Background(), func() (int, error) {
+			return 42, nil
+		},
+	)
+	if err != nil || got != 42 {
+		t.Fatalf("Expected the handler result, got %d, %v", got, err)
 	}
-
-	return resp, nil
 }
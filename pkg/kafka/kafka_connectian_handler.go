@@ -17,16 +17,32 @@ limitations under the License.
 package kafka
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"time"
 
+	"kcore/pkg/kerrors"
+	"kcore/pkg/logging"
 	"kcore/pkg/server"
 )
 
-const ProcessingQueueSize = 2
+const (
+	ProcessingQueueSize = 2
+
+	// ReadBufferSize is the size of the per-connection read buffer. Requests pipelined by the client that fit in the
+	// buffer are read without additional syscalls.
+	ReadBufferSize = 64 * 1024
+	// MaxPendingResponseBytes is the maximum number of response bytes queued on a connection before they are flushed.
+	MaxPendingResponseBytes = 1024 * 1024
+)
 
 type KafkaConnectionHandler interface {
 	server.ConnectionHandler
@@ -34,18 +50,45 @@ type KafkaConnectionHandler interface {
 }
 
 type kafkaConnectionHandler struct {
+	listener       Listener
+	config         Config
+	pool           *MemoryPool
+	clients        *ClientRegistry
 	conn           net.Conn
+	session        *Session
+	logger         *slog.Logger
 	ctx            context.Context
 	cancel         context.CancelFunc
 	requestHandler RequestHandler
+
+	// waitCtx is done when the connection must stop waiting for memory or for the end of a pause, it is cancelled with
+	// ctx or when the connection is drained.
+	waitCtx     context.Context
+	stopWaiting context.CancelFunc
 }
 
-func NewKafkaConnectionHandler(handler RequestHandler) KafkaConnectionHandler {
+// NewKafkaConnectionHandler creates a handler for a connection accepted on the listener. The memory of the requests
+// read from the connection is accounted for in pool, which is shared by all the connections, and the client is listed
+// in clients while connected.
+func NewKafkaConnectionHandler(
+	listener Listener,
+	config Config,
+	pool *MemoryPool,
+	clients *ClientRegistry,
+	handler RequestHandler,
+) KafkaConnectionHandler {
 	ctx, cancel := context.WithCancel(context.Background())
+	waitCtx, stopWaiting := context.WithCancel(ctx)
 	mgr := &kafkaConnectionHandler{
+		listener:       listener,
+		config:         config,
+		pool:           pool,
+		clients:        clients,
 		requestHandler: handler,
 		ctx:            ctx,
 		cancel:         cancel,
+		waitCtx:        waitCtx,
+		stopWaiting:    stopWaiting,
 	}
 	// TODO: return error
 	return mgr
@@ -53,57 +96,224 @@ func NewKafkaConnectionHandler(handler RequestHandler) KafkaConnectionHandler {
 
 func (h *kafkaConnectionHandler) HandleConnection(conn net.Conn) {
 	h.conn = conn
+	h.session = NewSession(h.listener, conn.RemoteAddr())
+	logger := h.config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	principal, err := h.buildPrincipal()
+	if err != nil {
+		logger.Error(
+			"Failed to build the principal of the client, closing connection", logging.ModuleKey, "kafka",
+			"session", h.session, "error", err,
+		)
+		conn.Close()
+		return
+	}
+	h.session.Principal = principal
+	if slices.Contains(h.config.HighPriorityPrincipals, principal) {
+		h.session.Priority = PriorityHigh
+	}
+	remoteAddr := ""
+	if conn.RemoteAddr() != nil {
+		remoteAddr = conn.RemoteAddr().String()
+	}
+	h.logger = logger.With(
+		logging.ModuleKey, "kafka", "connection id", h.session.ID, "remote address", remoteAddr, "listener", h.listener.Name,
+		"principal", h.session.Principal,
+	)
+	h.ctx = logging.NewContext(NewSessionContext(h.ctx, h.session), h.logger)
+	h.clients.Register(h.session, connectionCloser{conn: conn, cancel: h.cancel})
+	defer h.clients.Unregister(h.session)
 	h.run()
 }
 
+// Drain makes the connection stop waiting for memory or for the end of a pause, so that it is closed once the request
+// being handled is done. Waiting for data is interrupted by the server with a read deadline.
+func (h *kafkaConnectionHandler) Drain() {
+	h.stopWaiting()
+}
+
+// connectionCloser kills a connection for the ClientRegistry. Closing the connection is not enough to wake up its
+// handler while it waits for memory, so the context of the handler is cancelled as well.
+type connectionCloser struct {
+	conn   net.Conn
+	cancel context.CancelFunc
+}
+
+func (c connectionCloser) Close() error {
+	c.cancel()
+	return c.conn.Close()
+}
+
+// buildPrincipal builds the principal of the client with the configured PrincipalBuilder. The TLS handshake is already
+// completed by the server.
+func (h *kafkaConnectionHandler) buildPrincipal() (string, error) {
+	auth := AuthenticationContext{Listener: h.listener, RemoteAddr: h.conn.RemoteAddr()}
+	if tlsConn, ok := h.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		auth.TLS = &state
+	}
+	builder := h.config.PrincipalBuilder
+	if builder == nil {
+		builder = DefaultPrincipalBuilder{}
+	}
+	return builder.BuildPrincipal(auth)
+}
+
 /**
  * Starts reading from the connection
  * and handling requests.
+ *
+ * Responses are queued and flushed once there are no more pipelined requests
+ * buffered, so a batch of pipelined requests is answered with a single write.
  */
 func (h *kafkaConnectionHandler) run() {
-	defer h.conn.Close()
+	reader := bufio.NewReaderSize(h.conn, ReadBufferSize)
+	writer := newResponseWriter(h.conn, MaxPendingResponseBytes)
+	defer func() {
+		// Cancel the requests still being handled, nobody will read their responses
+		h.cancel()
+		if err := writer.Flush(); err != nil {
+			h.logger.Error("Failed to flush responses to connection", "error", err)
+		}
+		h.conn.Close()
+	}()
 	for {
+		if !h.shed(writer) {
+			return
+		}
 		// Read the request size (4 bytes)
 		buffer := make([]byte, 4)
-		slog.Debug("Reading request message size")
-		n, err := h.conn.Read(buffer)
+		h.logger.Debug("Reading request message size")
+		n, err := io.ReadFull(reader, buffer)
 		if err != nil {
 			if err == io.EOF {
 				return
 			}
-			slog.Error("Failed to read request message size from connection", err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				h.logger.Debug("Connection is being drained, closing it", "session", h.session)
+				return
+			}
+			h.logger.Error(
+				"Failed to read request message size from connection", "read bytes", n,
+				"error", err,
+			)
 			return
 		}
-		if n != 4 {
-			slog.Error("Failed to read request message size from connection", "read bytes", n, "Expected", 4)
+		if !h.listener.SecurityProtocol.UsesTLS() && isTLSHandshake(buffer) {
+			h.logger.Warn(
+				"Received a TLS handshake on a listener without TLS, is the client configured for SSL?",
+				"security protocol", h.listener.SecurityProtocol,
+			)
 			return
 		}
 		reqSize := binary.BigEndian.Uint32(buffer)
-		slog.Debug("Read request message size from connection", "bytes", n, "request message size", reqSize)
+		h.logger.Debug("Read request message size from connection", "bytes", n, "request message size", reqSize)
+		if h.config.MaxRequestSize > 0 && reqSize > uint32(h.config.MaxRequestSize) {
+			h.logger.Error(
+				"Request is larger than the maximum request size, closing connection",
+				"request message size", reqSize, "max request size", h.config.MaxRequestSize,
+			)
+			return
+		}
 
-		// Read the request (reqSize bytes)
-		buffer = make([]byte, reqSize)
-		n, err = h.conn.Read(buffer)
+		// Stop reading from the connection until there is enough memory for the request
+		var queueTime time.Duration
+		if !h.pool.TryAcquireWithPriority(int64(reqSize), h.session.Priority) {
+			// The client may be waiting for the queued responses before sending more and freeing memory
+			if err = writer.Flush(); err != nil {
+				h.logger.Error("Failed to write response to connection", "error", err)
+				return
+			}
+			queuedAt := time.Now()
+			if err = h.pool.AcquireWithPriority(h.waitCtx, int64(reqSize), h.session.Priority); err != nil {
+				h.logger.Debug("Gave up waiting for memory to read request", "error", err)
+				return
+			}
+			queueTime = time.Since(queuedAt)
+		}
+		if h.config.LoadShedder != nil {
+			h.config.LoadShedder.Record(h.session, int64(reqSize), queueTime)
+		}
+		resp, err := h.readAndHandle(reader, reqSize)
+		h.pool.Release(int64(reqSize))
 		if err != nil {
-			slog.Error("Failed to read request from connection", err)
 			return
 		}
-		if n != int(reqSize) {
-			slog.Error("Failed to read request from connection", "read bytes", n, "Expected", reqSize)
+
+		if err = writer.Queue(resp); err != nil {
+			h.logger.Error("Failed to write response to connection", "error", err)
 			return
 		}
-		slog.Debug("Read request from connection", "size", n)
-
-		// Handle the request
-		resp, err := h.requestHandler.Handle(buffer)
-		if err != nil {
-			slog.Error("Failed to handle request", err)
+		// Keep queueing while the client has pipelined more requests, flush once we caught up.
+		if reader.Buffered() > 0 {
+			continue
+		}
+		if err = writer.Flush(); err != nil {
+			h.logger.Error("Failed to write response to connection", "error", err)
 			return
 		}
+	}
+}
 
-		if _, err = h.conn.Write(resp); err != nil {
-			slog.Error("Failed to write response to connection", err)
-			return
+// shed pauses the connection before it reads its next request when the LoadShedder asks to, flushing the queued
+// responses first. It returns false if the connection must be closed.
+func (h *kafkaConnectionHandler) shed(writer *responseWriter) bool {
+	if h.config.LoadShedder == nil {
+		return true
+	}
+	pause := h.config.LoadShedder.Pause(h.session)
+	if pause <= 0 {
+		return true
+	}
+	if err := writer.Flush(); err != nil {
+		h.logger.Error("Failed to write response to connection", "error", err)
+		return false
+	}
+	h.logger.Debug("Broker is overloaded, pausing reads", "pause", pause)
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-h.waitCtx.Done():
+		return false
+	}
+}
+
+// isTLSHandshake returns true if the first bytes read from a connection are the header of a TLS handshake record
+// (content type 22, major version 3) rather than the size of a Kafka request.
+func isTLSHandshake(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0x16 && header[1] == 0x03
+}
+
+// readAndHandle reads a request of reqSize bytes from the connection and handles it. Errors are logged before being
+// returned, the connection must be closed when an error is returned.
+func (h *kafkaConnectionHandler) readAndHandle(reader io.Reader, reqSize uint32) (EncodedResponse, error) {
+	buffer := make([]byte, reqSize)
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			h.logger.Error(
+				"Failed to read request from connection", "read bytes", n,
+				"Expected", reqSize,
+			)
+			return nil, err
 		}
+		h.logger.Error("Failed to read request from connection", "error", err)
+		return nil, err
+	}
+	h.logger.Debug("Read request from connection", "size", n)
+
+	// Handle the request
+	resp, err := h.requestHandler.Handle(h.ctx, buffer)
+	if h.config.Capture != nil {
+		h.config.Capture.Record(h.session, buffer, resp)
+	}
+	if err != nil {
+		h.logger.Error("Failed to handle request", kerrors.Attr(err))
+		return nil, err
 	}
+	return resp, nil
 }
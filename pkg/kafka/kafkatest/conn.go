@@ -0,0 +1,242 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kafkatest provides utilities to test Kafka connection and request handlers without a network: a scripted
+// client connection, request builders and response assertions.
+//
+// It does not depend on the kafka package so that the tests of the kafka package can use it.
+package kafkatest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kcore-io/sarama"
+)
+
+// DefaultRemoteAddr is the remote address of a Conn, unless set with WithRemoteAddr.
+var DefaultRemoteAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+// NewRequest builds a request with the given correlation id, client id and body. The API key and version are the ones
+// of the body.
+func NewRequest(correlationID int32, clientID string, body sarama.ProtocolBody) sarama.Request {
+	return sarama.Request{
+		CorrelationID: correlationID,
+		ClientID:      clientID,
+		Body:          body,
+	}
+}
+
+// EncodeRequest encodes a request as a RequestHandler receives it, i.e. without the size prefix.
+func EncodeRequest(request sarama.Request) ([]byte, error) {
+	buf, err := sarama.Encode(&request, nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf[4:], nil
+}
+
+// expectation is the response expected for a scripted request.
+type expectation struct {
+	correlationID int32
+	headerVersion int16
+	bodyType      reflect.Type
+	bodyVersion   int16
+}
+
+// Conn is a client connection scripted by a test. The requests set with WithRequest are read by the handler in order,
+// and the responses it writes are decoded by ReadResponse in the same order.
+//
+// A Conn can be used by the handler goroutine and the test goroutine at the same time.
+type Conn struct {
+	mu         sync.Mutex
+	out        bytes.Buffer
+	in         bytes.Buffer
+	expected   []expectation
+	closed     bool
+	remoteAddr net.Addr
+}
+
+// NewConn creates a connection without requests, reading from it returns io.EOF.
+func NewConn() *Conn {
+	return &Conn{remoteAddr: DefaultRemoteAddr}
+}
+
+// WithRemoteAddr sets the address returned by RemoteAddr.
+func (c *Conn) WithRemoteAddr(addr net.Addr) *Conn {
+	c.remoteAddr = addr
+	return c
+}
+
+// WithRequest adds a request sent by the client. The requests are read in the order they were added, call it several
+// times to pipeline requests.
+func (c *Conn) WithRequest(request sarama.Request) *Conn {
+	buf, err := sarama.Encode(&request, nil)
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode request: %v", err))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out.Write(buf)
+	c.expected = append(
+		c.expected, expectation{
+			correlationID: request.CorrelationID,
+			bodyVersion:   request.Body.APIVersion(),
+		},
+	)
+	return c
+}
+
+// ExpectResponse sets the response expected for the last request added with WithRequest: the version of the response
+// header, the type of the response body and its version. By default, the body version is the request version.
+//
+// If no request has been added with WithRequest, this function will panic.
+func (c *Conn) ExpectResponse(headerVersion int16, body sarama.ProtocolBody, bodyVersion int16) *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.expected) == 0 {
+		panic("no request to respond to, call WithRequest first")
+	}
+	e := &c.expected[len(c.expected)-1]
+	e.headerVersion = headerVersion
+	e.bodyType = reflect.TypeOf(body).Elem()
+	e.bodyVersion = bodyVersion
+	return c
+}
+
+// Read returns the requests added with WithRequest, then io.EOF.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.out.Read(b)
+}
+
+// Write stores the responses written by the handler, they are decoded by ReadResponse.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.in.Write(b)
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Closed returns true if the handler closed the connection.
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// ReadResponse decodes the next response written to the connection, as set with ExpectResponse. It returns nil if the
+// handler did not write a response.
+//
+// If there is no request left to read the response of, this function will panic.
+func (c *Conn) ReadResponse() (*sarama.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.expected) == 0 {
+		panic("no response expected, call WithRequest first")
+	}
+	e := c.expected[0]
+	c.expected = c.expected[1:]
+	if e.bodyType == nil {
+		return nil, fmt.Errorf("no response type set for request %d, call ExpectResponse", e.correlationID)
+	}
+	if c.in.Len() == 0 {
+		return nil, nil
+	}
+	if c.in.Len() < 4 {
+		return nil, fmt.Errorf("truncated response size: %d bytes", c.in.Len())
+	}
+	size := int(binary.BigEndian.Uint32(c.in.Bytes()))
+	if c.in.Len() < 4+size {
+		return nil, fmt.Errorf("truncated response: %d bytes, expected %d", c.in.Len()-4, size)
+	}
+	buf := c.in.Next(4 + size)
+
+	resp := &sarama.Response{
+		Body:        reflect.New(e.bodyType).Interface().(sarama.ProtocolBody),
+		BodyVersion: e.bodyVersion,
+	}
+	if err := sarama.VersionedDecode(buf, resp, e.headerVersion, nil); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RequireResponse reads the next response with ReadResponse and fails the test if it can't be decoded or if its
+// correlation id does not match the one of the request.
+func (c *Conn) RequireResponse(t testing.TB) *sarama.Response {
+	t.Helper()
+	c.mu.Lock()
+	var correlationID int32
+	if len(c.expected) > 0 {
+		correlationID = c.expected[0].correlationID
+	}
+	c.mu.Unlock()
+	resp, err := c.ReadResponse()
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp == nil {
+		t.Fatalf("Expected a response to request %d, the connection has none", correlationID)
+	}
+	if resp.CorrelationID != correlationID {
+		t.Fatalf("Expected correlation id to be %d, got %d", correlationID, resp.CorrelationID)
+	}
+	return resp
+}
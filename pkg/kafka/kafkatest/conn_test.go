@@ -0,0 +1,88 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafkatest
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/kcore-io/sarama"
+)
+
+// TestConn plays the part of a handler: it reads the scripted requests and writes their responses in one write, like a
+// handler answering pipelined requests would.
+func TestConn(t *testing.T) {
+	conn := NewConn()
+	for i := int32(1); i <= 2; i++ {
+		conn.WithRequest(NewRequest(i, "test", &sarama.ApiVersionsRequest{Version: 0})).
+			ExpectResponse(0, &sarama.ApiVersionsResponse{}, 0)
+	}
+
+	var written []byte
+	for i := int32(1); i <= 2; i++ {
+		req := &sarama.Request{}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Failed to read request size: %v", err)
+		}
+		buf = make([]byte, binary.BigEndian.Uint32(buf))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Failed to read request: %v", err)
+		}
+		if err := req.Decode(&sarama.RealDecoder{Raw: buf}); err != nil {
+			t.Fatalf("Failed to decode request: %v", err)
+		}
+		if req.CorrelationID != i {
+			t.Fatalf("Expected correlation id %d, got %d", i, req.CorrelationID)
+		}
+		resp, err := sarama.Encode(
+			&sarama.Response{CorrelationID: i, Body: &sarama.ApiVersionsResponse{ErrorCode: int16(i)}}, nil,
+		)
+		if err != nil {
+			t.Fatalf("Failed to encode response: %v", err)
+		}
+		written = append(written, resp...)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected io.EOF once the requests are read, got %v", err)
+	}
+	if _, err := conn.Write(written); err != nil {
+		t.Fatalf("Failed to write responses: %v", err)
+	}
+
+	for i := int32(1); i <= 2; i++ {
+		resp := conn.RequireResponse(t)
+		if code := resp.Body.(*sarama.ApiVersionsResponse).ErrorCode; code != int16(i) {
+			t.Fatalf("Expected error code %d, got %d", i, code)
+		}
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	buf, err := EncodeRequest(NewRequest(42, "test", &sarama.ApiVersionsRequest{Version: 0}))
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+	req := &sarama.Request{}
+	if err = req.Decode(&sarama.RealDecoder{Raw: buf}); err != nil {
+		t.Fatalf("Failed to decode request without the size prefix: %v", err)
+	}
+	if req.CorrelationID != 42 || req.ClientID != "test" {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+}
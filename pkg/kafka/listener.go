@@ -0,0 +1,150 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SecurityProtocol is the protocol used by clients to talk to a listener.
+type SecurityProtocol string
+
+const (
+	Plaintext     SecurityProtocol = "PLAINTEXT"
+	SSL           SecurityProtocol = "SSL"
+	SaslPlaintext SecurityProtocol = "SASL_PLAINTEXT"
+	SaslSSL       SecurityProtocol = "SASL_SSL"
+)
+
+// DefaultListenerSecurityProtocolMap maps the listener names named after a security protocol to that protocol, and the
+// UNIX listener name to PLAINTEXT.
+const DefaultListenerSecurityProtocolMap = "PLAINTEXT:PLAINTEXT,SSL:SSL,SASL_PLAINTEXT:SASL_PLAINTEXT,SASL_SSL:SASL_SSL," +
+	"UNIX:PLAINTEXT"
+
+// UsesTLS returns true if connections must start with a TLS handshake.
+func (p SecurityProtocol) UsesTLS() bool {
+	return p == SSL || p == SaslSSL
+}
+
+// UsesSASL returns true if clients must authenticate with SASL before sending other requests.
+func (p SecurityProtocol) UsesSASL() bool {
+	return p == SaslPlaintext || p == SaslSSL
+}
+
+func parseSecurityProtocol(s string) (SecurityProtocol, error) {
+	switch p := SecurityProtocol(strings.ToUpper(s)); p {
+	case Plaintext, SSL, SaslPlaintext, SaslSSL:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown security protocol %q", s)
+	}
+}
+
+// Listener is an endpoint the broker accepts client connections on. It is either a TCP endpoint (Host and Port) or a
+// unix domain socket (Path) for co-located clients.
+type Listener struct {
+	Name             string
+	SecurityProtocol SecurityProtocol
+	Host             string
+	Port             int
+	Path             string
+	// Priority is the priority of the connections accepted on the listener, see ParseListenerPriorities.
+	Priority Priority
+}
+
+// IsUnix returns true if the listener is a unix domain socket.
+func (l Listener) IsUnix() bool {
+	return l.Path != ""
+}
+
+func (l Listener) String() string {
+	if l.IsUnix() {
+		return l.Name + "://" + l.Path
+	}
+	return l.Name + "://" + net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+}
+
+// ParseListeners parses a comma separated list of listeners in the NAME://host:port form, or NAME:///path/to/socket
+// for unix domain sockets. The security protocol of each listener is looked up by name in protocolMap, a comma
+// separated list of NAME:PROTOCOL pairs.
+func ParseListeners(listeners string, protocolMap string) ([]Listener, error) {
+	protocols := make(map[string]SecurityProtocol)
+	for _, entry := range strings.Split(protocolMap, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, protocol, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid listener security protocol map entry %q, expected NAME:PROTOCOL", entry)
+		}
+		p, err := parseSecurityProtocol(protocol)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener security protocol map entry %q: %w", entry, err)
+		}
+		protocols[strings.ToUpper(name)] = p
+	}
+
+	var result []Listener
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(listeners, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, hostPort, ok := strings.Cut(entry, "://")
+		if !ok {
+			return nil, fmt.Errorf("invalid listener %q, expected NAME://host:port", entry)
+		}
+		name = strings.ToUpper(name)
+		if names[name] {
+			return nil, fmt.Errorf("listener name %s is used more than once", name)
+		}
+		names[name] = true
+		protocol, ok := protocols[name]
+		if !ok {
+			return nil, fmt.Errorf("no security protocol defined for listener %s", name)
+		}
+		if strings.HasPrefix(hostPort, "/") {
+			result = append(result, Listener{Name: name, SecurityProtocol: protocol, Path: hostPort})
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: %w", entry, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid listener %q: invalid port %q", entry, portStr)
+		}
+		result = append(
+			result, Listener{
+				Name:             name,
+				SecurityProtocol: protocol,
+				Host:             host,
+				Port:             port,
+			},
+		)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no listeners defined")
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	tests := []struct {
+		name        string
+		listeners   string
+		protocolMap string
+		want        []Listener
+		wantErr     bool
+	}{
+		{
+			name:        "Default protocol map",
+			listeners:   "PLAINTEXT://127.0.0.1:9092,SSL://:9093",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			want: []Listener{
+				{Name: "PLAINTEXT", SecurityProtocol: Plaintext, Host: "127.0.0.1", Port: 9092},
+				{Name: "SSL", SecurityProtocol: SSL, Host: "", Port: 9093},
+			},
+		},
+		{
+			name:        "Custom listener names",
+			listeners:   "internal://[::1]:9092, external://0.0.0.0:9094",
+			protocolMap: "INTERNAL:PLAINTEXT,EXTERNAL:SASL_SSL",
+			want: []Listener{
+				{Name: "INTERNAL", SecurityProtocol: Plaintext, Host: "::1", Port: 9092},
+				{Name: "EXTERNAL", SecurityProtocol: SaslSSL, Host: "0.0.0.0", Port: 9094},
+			},
+		},
+		{
+			name:        "Unix domain socket",
+			listeners:   "PLAINTEXT://:9092,UNIX:///run/kcore/kcore.sock",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			want: []Listener{
+				{Name: "PLAINTEXT", SecurityProtocol: Plaintext, Host: "", Port: 9092},
+				{Name: "UNIX", SecurityProtocol: Plaintext, Path: "/run/kcore/kcore.sock"},
+			},
+		},
+		{
+			name:        "Listener missing from protocol map",
+			listeners:   "EXTERNAL://:9094",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			wantErr:     true,
+		},
+		{
+			name:        "Unknown security protocol",
+			listeners:   "EXTERNAL://:9094",
+			protocolMap: "EXTERNAL:KERBEROS",
+			wantErr:     true,
+		},
+		{
+			name:        "Duplicate listener name",
+			listeners:   "PLAINTEXT://:9092,PLAINTEXT://:9093",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			wantErr:     true,
+		},
+		{
+			name:        "Missing port",
+			listeners:   "PLAINTEXT://localhost",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			wantErr:     true,
+		},
+		{
+			name:        "No listeners",
+			listeners:   "",
+			protocolMap: DefaultListenerSecurityProtocolMap,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got, err := ParseListeners(tt.listeners, tt.protocolMap)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseListeners() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ParseListeners() got = %v, want %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"kcore/pkg/clock"
+	"kcore/pkg/logging"
+)
+
+const (
+	// LoadShedderWindow is the period over which the queue time of the requests is averaged to tell whether the broker
+	// is overloaded.
+	LoadShedderWindow = time.Second
+	// LoadShedderMinRequests is the number of requests a window needs for its queue time to open the circuit, so that
+	// a few slow requests on an idle broker don't trip it.
+	LoadShedderMinRequests = 10
+)
+
+// CircuitState is the state of the circuit breaker of a LoadShedder.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all the connections read requests as fast as the MemoryPool allows.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen pauses the reads of the heaviest connections.
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	if s == CircuitOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// MarshalText encodes the state as its name in the admin API.
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// LoadShedder protects the broker from overload. It measures how long requests are queued, waiting for memory in the
+// MemoryPool before being read. When the average queue time over a complete LoadShedderWindow of at least
+// LoadShedderMinRequests requests exceeds the threshold, the circuit opens and the normal priority connections that
+// read more than their share of the bytes in the window are paused before reading their next request, so that the
+// lighter clients keep being served. The circuit closes once the queue time is back under half the threshold.
+type LoadShedder struct {
+	threshold time.Duration
+	pause     time.Duration
+	clock     clock.Clock
+
+	mu    sync.Mutex
+	state CircuitState
+	since time.Time
+	// queueTime and windowRequests are the average queue time and the number of requests of the last complete window.
+	queueTime      time.Duration
+	windowRequests int64
+	windowStart    time.Time
+	// queued and requests are the total queue time and the number of requests of the current window.
+	queued   time.Duration
+	requests int64
+	// bytes is the number of bytes read by each normal priority connection in the current window, by connection id.
+	bytes  map[uint64]int64
+	total  int64
+	trips  uint64
+	pauses uint64
+}
+
+// LoadShedderStats are the metrics of a LoadShedder.
+type LoadShedderStats struct {
+	State CircuitState `json:"state"`
+	// Since is when the circuit entered its state.
+	Since time.Time `json:"since"`
+	// QueueTimeMs is the average queue time of the requests over the last complete window.
+	QueueTimeMs float64 `json:"queue_time_ms"`
+	// WindowRequests is the number of requests of the last complete window.
+	WindowRequests int64   `json:"window_requests"`
+	ThresholdMs    float64 `json:"threshold_ms"`
+	// Trips is the number of times the circuit opened.
+	Trips uint64 `json:"trips"`
+	// Pauses is the number of times a connection was paused.
+	Pauses uint64 `json:"pauses"`
+}
+
+// NewLoadShedder creates a load shedder opening its circuit when requests are queued for longer than threshold on
+// average, and pausing the heaviest connections for pause. The windows are measured with c, clock.Real outside tests.
+func NewLoadShedder(threshold time.Duration, pause time.Duration, c clock.Clock) *LoadShedder {
+	now := c.Now()
+	return &LoadShedder{
+		threshold:   threshold,
+		pause:       pause,
+		clock:       c,
+		since:       now,
+		windowStart: now,
+		bytes:       make(map[uint64]int64),
+	}
+}
+
+// Record records a request of size bytes read by the connection of session after being queued for queueTime.
+func (l *LoadShedder) Record(session *Session, size int64, queueTime time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll()
+	l.queued += queueTime
+	l.requests++
+	// High priority connections are never paused, they don't take a share of the window
+	if session.Priority != PriorityHigh {
+		l.bytes[session.ID] += size
+		l.total += size
+	}
+}
+
+// Pause returns how long the connection of session must wait before reading its next request. It is 0 unless the
+// circuit is open and the connection has a normal priority and read more than its share of the bytes of the window.
+func (l *LoadShedder) Pause(session *Session) time.Duration {
+	if session.Priority == PriorityHigh {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll()
+	if l.state != CircuitOpen || len(l.bytes) == 0 {
+		return 0
+	}
+	if l.bytes[session.ID]*int64(len(l.bytes)) <= l.total {
+		return 0
+	}
+	l.pauses++
+	return l.pause
+}
+
+// State returns the state of the circuit.
+func (l *LoadShedder) State() CircuitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll()
+	return l.state
+}
+
+// Stats returns the metrics of the load shedder.
+func (l *LoadShedder) Stats() LoadShedderStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll()
+	return LoadShedderStats{
+		State:          l.state,
+		Since:          l.since,
+		QueueTimeMs:    float64(l.queueTime) / float64(time.Millisecond),
+		WindowRequests: l.windowRequests,
+		ThresholdMs:    float64(l.threshold) / float64(time.Millisecond),
+		Trips:          l.trips,
+		Pauses:         l.pauses,
+	}
+}
+
+// roll starts a new window once the current one is over, and opens or closes the circuit according to the queue time
+// of the window that ended. The requests of the current window are never looked at, as the first ones of a window
+// would decide alone. l.mu must be held.
+func (l *LoadShedder) roll() {
+	now := l.clock.Now()
+	elapsed := now.Sub(l.windowStart)
+	if elapsed < LoadShedderWindow {
+		return
+	}
+	l.queueTime = 0
+	l.windowRequests = 0
+	// The last complete window is empty if the current one ended more than a window ago
+	if l.requests > 0 && elapsed < 2*LoadShedderWindow {
+		l.queueTime = l.queued / time.Duration(l.requests)
+		l.windowRequests = l.requests
+	}
+	l.windowStart = now
+	l.queued = 0
+	l.requests = 0
+	l.total = 0
+	clear(l.bytes)
+
+	switch {
+	case l.state == CircuitClosed && l.queueTime > l.threshold && l.windowRequests >= LoadShedderMinRequests:
+		l.state = CircuitOpen
+		l.since = now
+		l.trips++
+		logging.Module("kafka").Warn(
+			"Requests are queued for too long, pausing the heaviest connections", "queue time", l.queueTime,
+			"threshold", l.threshold,
+		)
+	case l.state == CircuitOpen && l.queueTime <= l.threshold/2:
+		l.state = CircuitClosed
+		l.since = now
+		logging.Module("kafka").Info("Requests queue time is back to normal", "queue time", l.queueTime)
+	}
+}
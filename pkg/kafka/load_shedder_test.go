@@ -0,0 +1,125 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"kcore/pkg/clock"
+)
+
+// record records n requests of the session.
+func record(shedder *LoadShedder, session *Session, n int, size int64, queueTime time.Duration) {
+	for i := 0; i < n; i++ {
+		shedder.Record(session, size, queueTime)
+	}
+}
+
+func TestLoadShedder(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	shedder := NewLoadShedder(100*time.Millisecond, 50*time.Millisecond, fake)
+	heavy := NewSession(Listener{}, nil)
+	light := NewSession(Listener{}, nil)
+	high := NewSession(Listener{Priority: PriorityHigh}, nil)
+
+	// Queued requests under the threshold keep the circuit closed
+	record(shedder, heavy, LoadShedderMinRequests, 1000, 50*time.Millisecond)
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitClosed {
+		t.Fatalf("Expected the circuit to be closed, got %v", state)
+	}
+
+	record(shedder, heavy, LoadShedderMinRequests, 1000, 300*time.Millisecond)
+	record(shedder, light, LoadShedderMinRequests, 10, 100*time.Millisecond)
+	// The requests of the window in progress don't count until it is over
+	if state := shedder.State(); state != CircuitClosed {
+		t.Fatalf("Expected the circuit to be closed until the window is over, got %v", state)
+	}
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitOpen {
+		t.Fatalf("Expected the circuit to be open, got %v", state)
+	}
+
+	// Only the connections reading more than their share of the window are paused
+	record(shedder, heavy, LoadShedderMinRequests, 1000, 300*time.Millisecond)
+	record(shedder, light, LoadShedderMinRequests, 10, 100*time.Millisecond)
+	record(shedder, high, LoadShedderMinRequests, 5000, 100*time.Millisecond)
+	tests := []struct {
+		name    string
+		session *Session
+		want    time.Duration
+	}{
+		{"heavy", heavy, 50 * time.Millisecond},
+		{"light", light, 0},
+		{"high priority", high, 0},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := shedder.Pause(tt.session); got != tt.want {
+					t.Fatalf("Expected a pause of %v, got %v", tt.want, got)
+				}
+			},
+		)
+	}
+
+	// The circuit stays open until the queue time is under half the threshold
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitOpen {
+		t.Fatalf("Expected the circuit to stay open, got %v", state)
+	}
+	record(shedder, light, LoadShedderMinRequests, 10, 40*time.Millisecond)
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitClosed {
+		t.Fatalf("Expected the circuit to be closed, got %v", state)
+	}
+	if got := shedder.Pause(heavy); got != 0 {
+		t.Fatalf("Expected no pause once the circuit is closed, got %v", got)
+	}
+
+	stats := shedder.Stats()
+	if stats.Trips != 1 || stats.Pauses != 1 || stats.ThresholdMs != 100 || !stats.Since.Equal(fake.Now()) ||
+		stats.WindowRequests != LoadShedderMinRequests {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestLoadShedderMinRequests(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	shedder := NewLoadShedder(100*time.Millisecond, 50*time.Millisecond, fake)
+	record(shedder, NewSession(Listener{}, nil), LoadShedderMinRequests-1, 1000, time.Second)
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitClosed {
+		t.Fatalf("Expected a few slow requests not to open the circuit, got %v", state)
+	}
+}
+
+func TestLoadShedderIdle(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	shedder := NewLoadShedder(100*time.Millisecond, 50*time.Millisecond, fake)
+	record(shedder, NewSession(Listener{}, nil), LoadShedderMinRequests, 1000, time.Second)
+	fake.Advance(LoadShedderWindow)
+	if state := shedder.State(); state != CircuitOpen {
+		t.Fatalf("Expected the circuit to be open, got %v", state)
+	}
+	// No requests for a whole window means nothing is queued anymore
+	fake.Advance(3 * LoadShedderWindow)
+	if state := shedder.State(); state != CircuitClosed {
+		t.Fatalf("Expected the circuit to be closed, got %v", state)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryPool accounts for the bytes of the requests being handled across all the connections of the broker. When the
+// pool is exhausted, connections stop reading new requests until memory is released, pushing back on the clients
+// through TCP flow control instead of running out of memory.
+//
+// Each connection reads its next request only once the previous one is answered, so the request bytes held by a
+// connection are bounded by the maximum request size. A slow client that does not read its responses stops the reads
+// of its own connection, which blocks writing them, without holding memory of the pool.
+//
+// Part of the pool can be reserved for high priority connections, which are also served first when memory is
+// released.
+type MemoryPool struct {
+	capacity int64
+	reserved int64
+
+	mu   sync.Mutex
+	used int64
+	// highWaiting is the number of high priority connections waiting for memory, normal ones wait until it's 0.
+	highWaiting int
+	// waiters are signaled, in order, when memory is released.
+	waiters []chan struct{}
+	// blocked is the total time connections spent waiting for memory.
+	blocked time.Duration
+}
+
+// NewMemoryPool creates a pool of capacity bytes. A capacity of 0 or less disables the limit.
+func NewMemoryPool(capacity int64) *MemoryPool {
+	return &MemoryPool{capacity: capacity}
+}
+
+// WithReserved reserves bytes of the pool for high priority connections. Normal connections block once the rest of
+// the pool is in use.
+func (p *MemoryPool) WithReserved(bytes int64) *MemoryPool {
+	p.reserved = bytes
+	return p
+}
+
+// Acquire reserves size bytes for a connection with the normal priority, see AcquireWithPriority.
+func (p *MemoryPool) Acquire(ctx context.Context, size int64) error {
+	return p.AcquireWithPriority(ctx, size, PriorityNormal)
+}
+
+// AcquireWithPriority reserves size bytes, blocking until they are available or ctx is done. A request larger than the
+// whole pool is let through once the pool is empty, so it can't block forever.
+func (p *MemoryPool) AcquireWithPriority(ctx context.Context, size int64, priority Priority) error {
+	if p.capacity <= 0 {
+		p.mu.Lock()
+		p.used += size
+		p.mu.Unlock()
+		return nil
+	}
+	var start time.Time
+	for {
+		p.mu.Lock()
+		if p.fits(size, priority) {
+			p.used += size
+			var waiters []chan struct{}
+			if !start.IsZero() {
+				p.blocked += time.Since(start)
+				if priority == PriorityHigh {
+					p.highWaiting--
+					// Normal connections that only waited for the high priority ones can go ahead
+					if p.highWaiting == 0 {
+						waiters = p.waiters
+						p.waiters = nil
+					}
+				}
+			}
+			p.mu.Unlock()
+			for _, wait := range waiters {
+				close(wait)
+			}
+			return nil
+		}
+		if start.IsZero() {
+			start = time.Now()
+			if priority == PriorityHigh {
+				p.highWaiting++
+			}
+		}
+		wait := make(chan struct{})
+		p.waiters = append(p.waiters, wait)
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.blocked += time.Since(start)
+			var waiters []chan struct{}
+			if priority == PriorityHigh {
+				p.highWaiting--
+				// Normal connections may have been waiting for this one
+				waiters = p.waiters
+				p.waiters = nil
+			}
+			p.mu.Unlock()
+			for _, wait := range waiters {
+				close(wait)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquireWithPriority reserves size bytes if they are available right away. It returns false, reserving nothing,
+// if AcquireWithPriority would block.
+func (p *MemoryPool) TryAcquireWithPriority(size int64, priority Priority) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.capacity > 0 && !p.fits(size, priority) {
+		return false
+	}
+	p.used += size
+	return true
+}
+
+// fits returns true if size bytes can be reserved for a connection with the given priority. p.mu must be held.
+func (p *MemoryPool) fits(size int64, priority Priority) bool {
+	limit := p.capacity
+	if priority < PriorityHigh {
+		limit -= p.reserved
+	}
+	fits := p.used == 0 || p.used+size <= limit
+	return fits && (priority == PriorityHigh || p.highWaiting == 0)
+}
+
+// Release returns size bytes to the pool.
+func (p *MemoryPool) Release(size int64) {
+	p.mu.Lock()
+	p.used -= size
+	waiters := p.waiters
+	p.waiters = nil
+	p.mu.Unlock()
+	for _, wait := range waiters {
+		close(wait)
+	}
+}
+
+// Used returns the number of bytes in use.
+func (p *MemoryPool) Used() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.used
+}
+
+// Saturation returns the fraction of the pool in use, between 0 and 1, or 0 if the pool is unlimited.
+func (p *MemoryPool) Saturation() float64 {
+	if p.capacity <= 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return min(float64(p.used)/float64(p.capacity), 1)
+}
+
+// BlockedTime returns the total time connections spent waiting for memory to be released.
+func (p *MemoryPool) BlockedTime() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blocked
+}
+
+// MemoryPoolStats are the metrics of a MemoryPool.
+type MemoryPoolStats struct {
+	// CapacityBytes is the size of the pool, 0 if it is unlimited.
+	CapacityBytes int64 `json:"capacity_bytes"`
+	ReservedBytes int64 `json:"reserved_bytes"`
+	UsedBytes     int64 `json:"used_bytes"`
+	// Saturation is the fraction of the pool in use, between 0 and 1.
+	Saturation float64 `json:"saturation"`
+	// BlockedMs is the total time connections spent waiting for memory.
+	BlockedMs float64 `json:"blocked_ms"`
+}
+
+// Stats returns the metrics of the pool.
+func (p *MemoryPool) Stats() MemoryPoolStats {
+	return MemoryPoolStats{
+		CapacityBytes: max(p.capacity, 0),
+		ReservedBytes: p.reserved,
+		UsedBytes:     p.Used(),
+		Saturation:    p.Saturation(),
+		BlockedMs:     float64(p.BlockedTime()) / float64(time.Millisecond),
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kafka/kafkatest"
+	"kcore/pkg/server"
+)
+
+func TestMemoryPoolBlocksWhenExhausted(t *testing.T) {
+	pool := NewMemoryPool(100)
+	if err := pool.Acquire(context.Background(), 80); err != nil {
+		t.Fatalf("Failed to acquire memory: %v", err)
+	}
+	if pool.Saturation() != 0.8 {
+		t.Fatalf("Expected saturation to be 0.8, got %f", pool.Saturation())
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- pool.Acquire(context.Background(), 50)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Expected the acquire to block while the pool is exhausted")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	pool.Release(80)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("Failed to acquire memory: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the acquire to unblock")
+	}
+	if pool.Used() != 50 {
+		t.Fatalf("Expected 50 bytes in use, got %d", pool.Used())
+	}
+	if pool.BlockedTime() == 0 {
+		t.Fatalf("Expected the blocked time to be recorded")
+	}
+}
+
+func TestMemoryPoolAcquireCancelled(t *testing.T) {
+	pool := NewMemoryPool(100)
+	if err := pool.Acquire(context.Background(), 100); err != nil {
+		t.Fatalf("Failed to acquire memory: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the acquire to be cancelled, got %v", err)
+	}
+	if pool.Used() != 100 {
+		t.Fatalf("Expected a cancelled acquire not to use memory, got %d bytes in use", pool.Used())
+	}
+}
+
+func TestMemoryPoolOversizedRequest(t *testing.T) {
+	pool := NewMemoryPool(100)
+	if err := pool.Acquire(context.Background(), 500); err != nil {
+		t.Fatalf("Expected a request larger than the pool to be let through an empty pool, got %v", err)
+	}
+	if pool.Saturation() != 1 {
+		t.Fatalf("Expected saturation to be capped to 1, got %f", pool.Saturation())
+	}
+}
+
+func TestMemoryPoolReservedForHighPriority(t *testing.T) {
+	pool := NewMemoryPool(100).WithReserved(20)
+	if err := pool.Acquire(context.Background(), 80); err != nil {
+		t.Fatalf("Failed to acquire memory: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected normal connections not to use the reserved memory, got %v", err)
+	}
+	if err := pool.AcquireWithPriority(context.Background(), 20, PriorityHigh); err != nil {
+		t.Fatalf("Expected high priority connections to use the reserved memory, got %v", err)
+	}
+}
+
+func TestMemoryPoolHighPriorityServedFirst(t *testing.T) {
+	pool := NewMemoryPool(100)
+	if err := pool.Acquire(context.Background(), 100); err != nil {
+		t.Fatalf("Failed to acquire memory: %v", err)
+	}
+	high := make(chan error, 1)
+	go func() {
+		high <- pool.AcquireWithPriority(context.Background(), 50, PriorityHigh)
+	}()
+	// Let the high priority connection wait first
+	time.Sleep(10 * time.Millisecond)
+	normal := make(chan error, 1)
+	go func() {
+		normal <- pool.Acquire(context.Background(), 60)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	pool.Release(100)
+	select {
+	case err := <-high:
+		if err != nil {
+			t.Fatalf("Failed to acquire memory: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the high priority acquire")
+	}
+	select {
+	case <-normal:
+		t.Fatalf("Expected the normal priority acquire to wait for the high priority one to release its memory")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.Release(50)
+	select {
+	case err := <-normal:
+		if err != nil {
+			t.Fatalf("Failed to acquire memory: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the normal priority acquire")
+	}
+}
+
+func TestMemoryPoolTryAcquire(t *testing.T) {
+	pool := NewMemoryPool(100).WithReserved(20)
+	if !pool.TryAcquireWithPriority(80, PriorityNormal) {
+		t.Fatalf("Expected the memory to be available")
+	}
+	if pool.TryAcquireWithPriority(1, PriorityNormal) {
+		t.Fatalf("Expected normal connections not to use the reserved memory")
+	}
+	if !pool.TryAcquireWithPriority(20, PriorityHigh) {
+		t.Fatalf("Expected high priority connections to use the reserved memory")
+	}
+	stats := pool.Stats()
+	if stats.UsedBytes != 100 || stats.CapacityBytes != 100 || stats.ReservedBytes != 20 || stats.Saturation != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// writeNotifyingConn signals the first write of the handler.
+type writeNotifyingConn struct {
+	*kafkatest.Conn
+	once    sync.Once
+	written chan struct{}
+}
+
+func (c *writeNotifyingConn) Write(b []byte) (int, error) {
+	c.once.Do(
+		func() {
+			close(c.written)
+		},
+	)
+	return c.Conn.Write(b)
+}
+
+// memoryHog takes the memory of the pool while the first request is handled, like other connections would.
+type memoryHog struct {
+	RequestHandler
+	pool *MemoryPool
+	once sync.Once
+}
+
+func (h *memoryHog) Handle(ctx context.Context, req EncodedRequest) (EncodedResponse, error) {
+	h.once.Do(
+		func() {
+			h.pool.TryAcquireWithPriority(h.pool.capacity-h.pool.Used(), PriorityNormal)
+		},
+	)
+	return h.RequestHandler.Handle(ctx, req)
+}
+
+// TestConnectionFlushesBeforeWaitingForMemory tests that the responses of pipelined requests are written before
+// waiting for memory, a client waiting for them would otherwise never send what frees memory
+func TestConnectionFlushesBeforeWaitingForMemory(t *testing.T) {
+	pool := NewMemoryPool(1000)
+	conn := &writeNotifyingConn{Conn: kafkatest.NewConn(), written: make(chan struct{})}
+	// The second request is larger than the first one, it doesn't fit in the memory the first one releases
+	for i, clientID := range []string{"rdkafka", "rdkafka-consumer"} {
+		conn.WithRequest(kafkatest.NewRequest(int32(i+1), clientID, &sarama.ApiVersionsRequest{Version: 0})).
+			ExpectResponse(ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 0)
+	}
+	hog := &memoryHog{RequestHandler: NewKafkaApi(DefaultConfig(), NewClientRegistry()), pool: pool}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewKafkaConnectionHandler(TestListener, DefaultConfig(), pool, NewClientRegistry(), hog).HandleConnection(conn)
+	}()
+
+	select {
+	case <-conn.written:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the first response to be written while waiting for memory")
+	}
+	if pool.Saturation() < 0.9 {
+		t.Fatalf("Expected the pool to be exhausted, got a saturation of %f", pool.Saturation())
+	}
+	pool.Release(pool.Used())
+	<-done
+	for i := 0; i < 2; i++ {
+		conn.RequireResponse(t)
+	}
+}
+
+// TestConnectionWaitingForMemoryStops tests that a connection waiting for memory returns when it is killed or drained,
+// instead of waiting for other connections to release memory
+func TestConnectionWaitingForMemoryStops(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(h KafkaConnectionHandler, clients *ClientRegistry, session uint64)
+	}{
+		{
+			"Killed", func(h KafkaConnectionHandler, clients *ClientRegistry, session uint64) {
+				clients.Close(session)
+			},
+		},
+		{
+			"Drained", func(h KafkaConnectionHandler, clients *ClientRegistry, session uint64) {
+				h.(server.Drainer).Drain()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				pool := NewMemoryPool(1000)
+				pool.Acquire(context.Background(), 1000)
+				conn := kafkatest.NewConn().
+					WithRequest(kafkatest.NewRequest(1, "rdkafka", &sarama.ApiVersionsRequest{Version: 0}))
+				clients := NewClientRegistry()
+				h := NewKafkaConnectionHandler(
+					TestListener, DefaultConfig(), pool, clients, NewKafkaApi(DefaultConfig(), clients),
+				)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					h.HandleConnection(conn)
+				}()
+				for len(clients.Clients()) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+
+				tt.stop(h, clients, clients.Clients()[0].ConnectionID)
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatalf("Expected the connection waiting for memory to return")
+				}
+				if pool.Used() != 1000 {
+					t.Fatalf("Expected the connection not to hold memory, %d bytes are used", pool.Used())
+				}
+			},
+		)
+	}
+}
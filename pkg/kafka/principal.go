@@ -0,0 +1,63 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// AuthenticationContext is what is known about the client of a connection once it authenticated, from which its
+// principal is built.
+type AuthenticationContext struct {
+	// Listener is the listener the connection was accepted on.
+	Listener   Listener
+	RemoteAddr net.Addr
+	// TLS is the state of the TLS connection, nil on listeners without TLS.
+	TLS *tls.ConnectionState
+	// SASLIdentity is the authorization id of a client that authenticated with SASL, empty otherwise.
+	SASLIdentity string
+}
+
+// PrincipalBuilder builds the principal of the client of a connection, e.g. User:alice, which is logged and matched
+// by the authorizer. Embedders can replace DefaultPrincipalBuilder to map identities to their own scheme.
+type PrincipalBuilder interface {
+	// BuildPrincipal returns the principal of the client. The connection is closed if an error is returned.
+	BuildPrincipal(auth AuthenticationContext) (string, error)
+}
+
+// PrincipalBuilderFunc is a function implementing PrincipalBuilder.
+type PrincipalBuilderFunc func(auth AuthenticationContext) (string, error)
+
+func (f PrincipalBuilderFunc) BuildPrincipal(auth AuthenticationContext) (string, error) {
+	return f(auth)
+}
+
+// DefaultPrincipalBuilder builds principals like Kafka's default principal builder: User:<SASL identity> for clients
+// that authenticated with SASL, User:<subject DN> for clients that presented a TLS certificate, e.g.
+// User:CN=alice,O=kcore, and AnonymousPrincipal otherwise.
+type DefaultPrincipalBuilder struct{}
+
+func (DefaultPrincipalBuilder) BuildPrincipal(auth AuthenticationContext) (string, error) {
+	if auth.SASLIdentity != "" {
+		return "User:" + auth.SASLIdentity, nil
+	}
+	if auth.TLS != nil && len(auth.TLS.PeerCertificates) > 0 {
+		return "User:" + auth.TLS.PeerCertificates[0].Subject.String(), nil
+	}
+	return AnonymousPrincipal, nil
+}
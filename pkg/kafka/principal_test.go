@@ -0,0 +1,113 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+
+	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/kafka/kafkatest"
+)
+
+func TestDefaultPrincipalBuilder(t *testing.T) {
+	clientCert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", Organization: []string{"kcore"}}}
+	tests := []struct {
+		name string
+		auth AuthenticationContext
+		want string
+	}{
+		{"Plaintext", AuthenticationContext{Listener: TestListener}, AnonymousPrincipal},
+		{"TLS without client certificate", AuthenticationContext{TLS: &tls.ConnectionState{}}, AnonymousPrincipal},
+		{
+			"TLS client certificate",
+			AuthenticationContext{TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}},
+			"User:CN=alice,O=kcore",
+		},
+		{
+			"SASL identity over TLS",
+			AuthenticationContext{
+				TLS:          &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}},
+				SASLIdentity: "bob",
+			},
+			"User:bob",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got, err := DefaultPrincipalBuilder{}.BuildPrincipal(tt.auth)
+				if err != nil {
+					t.Fatalf("BuildPrincipal() error = %v", err)
+				}
+				if got != tt.want {
+					t.Fatalf("Expected principal %q, got %q", tt.want, got)
+				}
+			},
+		)
+	}
+}
+
+func TestCustomPrincipalBuilder(t *testing.T) {
+	config := DefaultConfig()
+	config.PrincipalBuilder = PrincipalBuilderFunc(
+		func(auth AuthenticationContext) (string, error) {
+			if auth.Listener.Name != TestListener.Name {
+				return "", errors.New("unknown listener")
+			}
+			return "Service:" + auth.RemoteAddr.String(), nil
+		},
+	)
+
+	clients := NewClientRegistry()
+	api := &principalRecorder{RequestHandler: NewKafkaApi(config, clients)}
+	conn := kafkatest.NewConn().WithRequest(kafkatest.NewRequest(1, "client", &sarama.ApiVersionsRequest{})).
+		ExpectResponse(ResponseHeaderVersion, &sarama.ApiVersionsResponse{}, 0)
+	NewKafkaConnectionHandler(TestListener, config, NewMemoryPool(0), clients, api).HandleConnection(conn)
+	conn.RequireResponse(t)
+	if want := "Service:" + kafkatest.DefaultRemoteAddr.String(); api.principal != want {
+		t.Fatalf("Expected principal %q, got %q", want, api.principal)
+	}
+
+	// Connections whose principal can't be built are closed without handling their requests
+	conn = kafkatest.NewConn().WithRequest(kafkatest.NewRequest(1, "client", &sarama.ApiVersionsRequest{}))
+	NewKafkaConnectionHandler(Listener{Name: "EXTERNAL"}, config, NewMemoryPool(0), clients, api).HandleConnection(conn)
+	if !conn.Closed() {
+		t.Fatalf("Expected the connection to be closed")
+	}
+	if _, err := conn.ReadResponse(); err == nil {
+		t.Fatalf("Expected no response")
+	}
+}
+
+// principalRecorder records the principal of the session the requests are handled for.
+type principalRecorder struct {
+	RequestHandler
+	principal string
+}
+
+func (r *principalRecorder) Handle(ctx context.Context, req EncodedRequest) (EncodedResponse, error) {
+	if session, ok := SessionFromContext(ctx); ok {
+		r.principal = session.Principal
+	}
+	return r.RequestHandler.Handle(ctx, req)
+}
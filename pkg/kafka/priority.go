@@ -0,0 +1,80 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority is the priority of the requests of a connection when the broker is overloaded. Connections with a high
+// priority, e.g. admin tools, can use the memory the MemoryPool reserves for them and are served before the others
+// when memory is released, so that bulk traffic does not starve them.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	if p == PriorityHigh {
+		return "HIGH"
+	}
+	return "NORMAL"
+}
+
+func parsePriority(s string) (Priority, error) {
+	switch strings.ToUpper(s) {
+	case "NORMAL":
+		return PriorityNormal, nil
+	case "HIGH":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("unknown priority %q, expected NORMAL or HIGH", s)
+	}
+}
+
+// ParseListenerPriorities sets the priority of the listeners from a comma separated list of NAME:PRIORITY pairs, e.g.
+// "INTERNAL:HIGH". Listeners that are not listed keep the normal priority.
+func ParseListenerPriorities(listeners []Listener, priorities string) error {
+	for _, entry := range strings.Split(priorities, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, priority, ok := strings.Cut(entry, ":")
+		if !ok {
+			return fmt.Errorf("invalid listener priority %q, expected NAME:PRIORITY", entry)
+		}
+		p, err := parsePriority(priority)
+		if err != nil {
+			return fmt.Errorf("invalid listener priority %q: %w", entry, err)
+		}
+		found := false
+		for i := range listeners {
+			if strings.EqualFold(listeners[i].Name, name) {
+				listeners[i].Priority = p
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid listener priority %q: no listener named %s", entry, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"testing"
+)
+
+func TestParseListenerPriorities(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities string
+		want       []Priority
+		wantErr    bool
+	}{
+		{"No priorities", "", []Priority{PriorityNormal, PriorityNormal}, false},
+		{"High priority listener", "internal:high", []Priority{PriorityNormal, PriorityHigh}, false},
+		{"Explicit normal priority", "PLAINTEXT:NORMAL,INTERNAL:HIGH", []Priority{PriorityNormal, PriorityHigh}, false},
+		{"Unknown listener", "EXTERNAL:HIGH", nil, true},
+		{"Unknown priority", "INTERNAL:URGENT", nil, true},
+		{"Missing priority", "INTERNAL", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				listeners := []Listener{{Name: "PLAINTEXT"}, {Name: "INTERNAL"}}
+				err := ParseListenerPriorities(listeners, tt.priorities)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseListenerPriorities() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if tt.wantErr {
+					return
+				}
+				for i, want := range tt.want {
+					if listeners[i].Priority != want {
+						t.Fatalf(
+							"Expected listener %s to have priority %s, got %s", listeners[i].Name, want,
+							listeners[i].Priority,
+						)
+					}
+				}
+			},
+		)
+	}
+}
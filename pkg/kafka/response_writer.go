@@ -0,0 +1,82 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// responseWriter queues encoded responses for a single connection and writes them to the connection in one vectored
+// write (writev on TCP connections) when flushed.
+//
+// A responseWriter is not safe for concurrent use; it is owned by the connection handler goroutine.
+type responseWriter struct {
+	conn            io.Writer
+	bufs            [][]byte
+	size            int
+	maxPendingBytes int
+}
+
+func newResponseWriter(conn io.Writer, maxPendingBytes int) *responseWriter {
+	return &responseWriter{
+		conn:            conn,
+		maxPendingBytes: maxPendingBytes,
+	}
+}
+
+// Queue adds the response to the pending responses. If the pending responses exceed the maximum pending bytes, all of
+// them are flushed to the connection.
+func (w *responseWriter) Queue(resp EncodedResponse) error {
+	if len(resp) == 0 {
+		return nil
+	}
+	w.bufs = append(w.bufs, resp)
+	w.size += len(resp)
+	if w.size >= w.maxPendingBytes {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes all the pending responses to the connection. A short write is reported as an error as the connection
+// can't be used anymore once a response has been partially written.
+func (w *responseWriter) Flush() error {
+	if w.size == 0 {
+		return nil
+	}
+	defer w.reset()
+
+	// net.Buffers consumes the slice it writes, so it gets its own header over the pending buffers.
+	pending := net.Buffers(w.bufs)
+	n, err := pending.WriteTo(w.conn)
+	if err != nil {
+		return fmt.Errorf("failed to write %d response bytes, wrote %d: %w", w.size, n, err)
+	}
+	if n != int64(w.size) {
+		return fmt.Errorf("failed to write %d response bytes, wrote %d: %w", w.size, n, io.ErrShortWrite)
+	}
+	return nil
+}
+
+func (w *responseWriter) reset() {
+	// Release the references to the written responses so they can be garbage collected.
+	clear(w.bufs)
+	w.bufs = w.bufs[:0]
+	w.size = 0
+}
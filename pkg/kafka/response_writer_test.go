@@ -0,0 +1,89 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// limitedWriter records every write it receives. If limit is set, writes are cut short after limit bytes without
+// returning an error, like a misbehaving connection would.
+type limitedWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if w.limit > 0 && len(b) > w.limit {
+		b = b[:w.limit]
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestResponseWriterQueueAndFlush(t *testing.T) {
+	w := &limitedWriter{}
+	rw := newResponseWriter(w, 1024)
+
+	for _, resp := range []string{"first", "second", "third"} {
+		if err := rw.Queue(EncodedResponse(resp)); err != nil {
+			t.Fatalf("Failed to queue response: %v", err)
+		}
+	}
+	if w.Len() != 0 {
+		t.Fatalf("Expected no bytes to be written before flushing, got %d", w.Len())
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("Failed to flush responses: %v", err)
+	}
+	if w.String() != "firstsecondthird" {
+		t.Fatalf("Expected responses to be written in order, got %q", w.String())
+	}
+	if err := rw.Flush(); err != nil || w.String() != "firstsecondthird" {
+		t.Fatalf("Expected nothing to be written by a second flush, got %q, error %v", w.String(), err)
+	}
+}
+
+func TestResponseWriterFlushesWhenFull(t *testing.T) {
+	w := &limitedWriter{}
+	rw := newResponseWriter(w, 8)
+
+	if err := rw.Queue(EncodedResponse("1234")); err != nil {
+		t.Fatalf("Failed to queue response: %v", err)
+	}
+	if err := rw.Queue(EncodedResponse("5678")); err != nil {
+		t.Fatalf("Failed to queue response: %v", err)
+	}
+	if w.String() != "12345678" {
+		t.Fatalf("Expected responses to be flushed once the limit is reached, got %q", w.String())
+	}
+}
+
+func TestResponseWriterShortWrite(t *testing.T) {
+	w := &limitedWriter{limit: 2}
+	rw := newResponseWriter(w, 1024)
+
+	if err := rw.Queue(EncodedResponse("response")); err != nil {
+		t.Fatalf("Failed to queue response: %v", err)
+	}
+	err := rw.Flush()
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Expected a short write error, got %v", err)
+	}
+}
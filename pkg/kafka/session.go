@@ -0,0 +1,91 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+)
+
+// AnonymousPrincipal is the principal of connections that did not authenticate.
+const AnonymousPrincipal = "User:ANONYMOUS"
+
+// Session holds what is known about the client on the other end of a connection. It is created when the connection is
+// accepted and filled in as requests are received, so that logs, metrics and quotas can be attributed to the client.
+//
+// A session is only modified by the goroutine handling its connection.
+type Session struct {
+	// ID identifies the connection in the logs and the admin API. It is unique for the lifetime of the process.
+	ID         uint64
+	RemoteAddr net.Addr
+	// Listener is the listener the connection was accepted on.
+	Listener  Listener
+	Principal string
+	// ClientID is the client id sent in the header of the last request.
+	ClientID string
+	// ClientSoftwareName and ClientSoftwareVersion are sent by the client in ApiVersions requests (v3+).
+	ClientSoftwareName    string
+	ClientSoftwareVersion string
+	// Priority is the priority of the requests of the connection when the broker is overloaded.
+	Priority Priority
+}
+
+var nextSessionID atomic.Uint64
+
+// NewSession creates the session of a connection accepted on the listener from the given remote address.
+func NewSession(listener Listener, remoteAddr net.Addr) *Session {
+	return &Session{
+		ID:         nextSessionID.Add(1),
+		RemoteAddr: remoteAddr,
+		Listener:   listener,
+		Principal:  AnonymousPrincipal,
+		Priority:   listener.Priority,
+	}
+}
+
+// LogValue implements slog.LogValuer so that a session can be logged as a group of attributes.
+func (s *Session) LogValue() slog.Value {
+	remoteAddr := ""
+	if s.RemoteAddr != nil {
+		remoteAddr = s.RemoteAddr.String()
+	}
+	return slog.GroupValue(
+		slog.Uint64("connection id", s.ID),
+		slog.String("remote address", remoteAddr),
+		slog.String("listener", s.Listener.Name),
+		slog.String("principal", s.Principal),
+		slog.String("client id", s.ClientID),
+		slog.String("client software name", s.ClientSoftwareName),
+		slog.String("client software version", s.ClientSoftwareVersion),
+		slog.String("priority", s.Priority.String()),
+	)
+}
+
+type sessionKey struct{}
+
+// NewSessionContext returns a copy of ctx that carries the session.
+func NewSessionContext(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext returns the session carried by ctx, if any.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	return session, ok
+}
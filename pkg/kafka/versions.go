@@ -16,10 +16,14 @@ limitations under the License.
 
 package kafka
 
-// TODO: Add support for multiple versions
 const (
 	ApiVersionsApiKey = 18
 
-	ApiVersionsRequestVersion = 3
-	ResponseHeaderVersion     = 0
+	// ApiVersionsMinVersion and ApiVersionsMaxVersion are the ApiVersions versions supported by kcore. Clients such as
+	// librdkafka fall back to v0 when they don't know the broker version.
+	ApiVersionsMinVersion = 0
+	ApiVersionsMaxVersion = 3
+	// ResponseHeaderVersion is the version of the ApiVersions response header, which is always v0 so that clients can
+	// read it before knowing the versions supported by the broker.
+	ResponseHeaderVersion = 0
 )
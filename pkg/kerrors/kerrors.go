@@ -0,0 +1,133 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kerrors maps the errors of kcore to the Kafka protocol error codes sent to clients, and tells whether
+// clients can retry them.
+package kerrors
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/kcore-io/sarama"
+)
+
+// Error is an error answered to the client with a Kafka protocol error code.
+type Error struct {
+	Code    sarama.KError
+	Message string
+	// Err is the cause of the error, if any.
+	Err error
+}
+
+// New creates an error with the given code and message.
+func New(code sarama.KError, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap creates an error with the given code and message caused by err.
+func Wrap(code sarama.KError, err error, message string) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Code.Error()
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, code) true for an Error with that code, e.g. errors.Is(err, sarama.ErrInvalidRequest).
+func (e *Error) Is(target error) bool {
+	code, ok := target.(sarama.KError)
+	return ok && code == e.Code
+}
+
+// Code returns the Kafka error code to send to the client for err. Context errors are mapped to REQUEST_TIMED_OUT and
+// errors without a code to UNKNOWN_SERVER_ERROR.
+func Code(err error) sarama.KError {
+	if err == nil {
+		return sarama.ErrNoError
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	var code sarama.KError
+	if errors.As(err, &code) {
+		return code
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return sarama.ErrRequestTimedOut
+	}
+	return sarama.ErrUnknown
+}
+
+// retriable are the error codes of the Kafka RetriableException subclasses: the request may succeed if sent again.
+var retriable = map[sarama.KError]bool{
+	sarama.ErrInvalidMessage:                  true,
+	sarama.ErrUnknownTopicOrPartition:         true,
+	sarama.ErrLeaderNotAvailable:              true,
+	sarama.ErrNotLeaderForPartition:           true,
+	sarama.ErrRequestTimedOut:                 true,
+	sarama.ErrNetworkException:                true,
+	sarama.ErrOffsetsLoadInProgress:           true,
+	sarama.ErrConsumerCoordinatorNotAvailable: true,
+	sarama.ErrNotCoordinatorForConsumer:       true,
+	sarama.ErrNotEnoughReplicas:               true,
+	sarama.ErrNotEnoughReplicasAfterAppend:    true,
+	sarama.ErrNotController:                   true,
+	sarama.ErrConcurrentTransactions:          true,
+	sarama.ErrKafkaStorageError:               true,
+	sarama.ErrFetchSessionIDNotFound:          true,
+	sarama.ErrInvalidFetchSessionEpoch:        true,
+	sarama.ErrFencedLeaderEpoch:               true,
+	sarama.ErrUnknownLeaderEpoch:              true,
+	sarama.ErrOffsetNotAvailable:              true,
+	sarama.ErrPreferredLeaderNotAvailable:     true,
+	sarama.ErrEligibleLeadersNotAvailable:     true,
+	sarama.ErrUnstableOffsetCommit:            true,
+	sarama.ErrThrottlingQuotaExceeded:         true,
+}
+
+// Retriable returns true if the client may retry the request that failed with err.
+func Retriable(err error) bool {
+	return retriable[Code(err)]
+}
+
+// Attr returns err as a group of log attributes with its message, Kafka error code and whether it is retriable, so
+// that errors are logged the same way everywhere.
+func Attr(err error) slog.Attr {
+	if err == nil {
+		return slog.Group("error")
+	}
+	code := Code(err)
+	return slog.Group(
+		"error",
+		slog.String("message", err.Error()),
+		slog.Int("code", int(code)),
+		slog.Bool("retriable", retriable[code]),
+	)
+}
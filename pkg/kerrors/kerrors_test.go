@@ -0,0 +1,77 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/kcore-io/sarama"
+)
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCode      sarama.KError
+		wantRetriable bool
+	}{
+		{"No error", nil, sarama.ErrNoError, false},
+		{"Error", New(sarama.ErrInvalidRequest, "bad request"), sarama.ErrInvalidRequest, false},
+		{
+			"Wrapped error", fmt.Errorf("dispatch: %w", Wrap(sarama.ErrNotController, io.EOF, "no controller")),
+			sarama.ErrNotController, true,
+		},
+		{
+			"Protocol error code", fmt.Errorf("response: %w", sarama.ErrLeaderNotAvailable),
+			sarama.ErrLeaderNotAvailable, true,
+		},
+		{"Deadline exceeded", context.DeadlineExceeded, sarama.ErrRequestTimedOut, true},
+		{"Unknown error", io.ErrUnexpectedEOF, sarama.ErrUnknown, false},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := Code(tt.err); got != tt.wantCode {
+					t.Fatalf("Code() = %d, want %d", got, tt.wantCode)
+				}
+				if got := Retriable(tt.err); got != tt.wantRetriable {
+					t.Fatalf("Retriable() = %v, want %v", got, tt.wantRetriable)
+				}
+			},
+		)
+	}
+}
+
+func TestErrorWrapping(t *testing.T) {
+	err := fmt.Errorf("handle: %w", Wrap(sarama.ErrInvalidRequest, io.ErrUnexpectedEOF, "failed to decode request"))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected the cause to be unwrapped")
+	}
+	if !errors.Is(err, sarama.ErrInvalidRequest) {
+		t.Fatalf("Expected the error to match its code")
+	}
+	if got, want := err.Error(), "handle: failed to decode request: unexpected EOF"; got != want {
+		t.Fatalf("Error() = %q, want %q", got, want)
+	}
+	if got, want := New(sarama.ErrRequestTimedOut, "").Error(), sarama.ErrRequestTimedOut.Error(); got != want {
+		t.Fatalf("Expected an error without message to use the code description, got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// ModuleKey is the attribute naming the module a log comes from, e.g. server or kafka. The level of each module can
+// be changed at runtime, see Levels.
+const ModuleKey = "module"
+
+// Module returns the default logger tagged with the module name. It must be called when logging rather than once, so
+// that it picks up the default logger set at startup. The logger of each module is cached until the default logger
+// changes, calling Module does not allocate.
+func Module(name string) *slog.Logger {
+	base := slog.Default()
+	if cached, ok := moduleLoggers.Load(name); ok && cached.(*moduleLogger).base == base {
+		return cached.(*moduleLogger).logger
+	}
+	logger := base.With(ModuleKey, name)
+	moduleLoggers.Store(name, &moduleLogger{base: base, logger: logger})
+	return logger
+}
+
+// moduleLoggers caches the logger of each module by name.
+var moduleLoggers sync.Map
+
+// moduleLogger is the logger of a module, derived from the base default logger.
+type moduleLogger struct {
+	base   *slog.Logger
+	logger *slog.Logger
+}
+
+// Levels holds the log level of each module, and the default level of the modules without one. It is safe for
+// concurrent use, levels can be changed while logging.
+type Levels struct {
+	mu           sync.RWMutex
+	defaultLevel slog.Level
+	modules      map[string]slog.Level
+}
+
+// NewLevels creates levels where every module logs at the given level.
+func NewLevels(level slog.Level) *Levels {
+	return &Levels{
+		defaultLevel: level,
+		modules:      make(map[string]slog.Level),
+	}
+}
+
+// Level returns the level of the module.
+func (l *Levels) Level(module string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.modules[module]; ok {
+		return level
+	}
+	return l.defaultLevel
+}
+
+// Set sets the level of the module. The empty module name sets the default level.
+func (l *Levels) Set(module string, level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if module == "" {
+		l.defaultLevel = level
+		return
+	}
+	l.modules[module] = level
+}
+
+// Reset makes the module log at the default level again.
+func (l *Levels) Reset(module string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.modules, module)
+}
+
+// All returns the levels set per module, and the default level under the empty module name.
+func (l *Levels) All() map[string]slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	all := make(map[string]slog.Level, len(l.modules)+1)
+	for module, level := range l.modules {
+		all[module] = level
+	}
+	all[""] = l.defaultLevel
+	return all
+}
+
+// ParseLevels parses a comma separated list of MODULE=LEVEL pairs, e.g. "server=debug,kafka=warn", and sets them.
+func (l *Levels) ParseLevels(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		module, levelStr, ok := strings.Cut(entry, "=")
+		if !ok || module == "" {
+			return fmt.Errorf("invalid log level %q, expected MODULE=LEVEL", entry)
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			return fmt.Errorf("invalid log level %q: %w", entry, err)
+		}
+		l.Set(module, level)
+	}
+	return nil
+}
+
+// NewHandler returns a handler that drops the records below the level of their module, as set with the ModuleKey
+// attribute on the logger, before passing them to h. h should accept every level.
+func NewHandler(h slog.Handler, levels *Levels) slog.Handler {
+	return &moduleHandler{h: h, levels: levels}
+}
+
+type moduleHandler struct {
+	h      slog.Handler
+	levels *Levels
+	module string
+}
+
+func (m *moduleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= m.levels.Level(m.module) && m.h.Enabled(ctx, level)
+}
+
+func (m *moduleHandler) Handle(ctx context.Context, r slog.Record) error {
+	return m.h.Handle(ctx, r)
+}
+
+func (m *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	module := m.module
+	for _, a := range attrs {
+		if a.Key == ModuleKey {
+			module = a.Value.String()
+		}
+	}
+	return &moduleHandler{h: m.h.WithAttrs(attrs), levels: m.levels, module: module}
+}
+
+func (m *moduleHandler) WithGroup(name string) slog.Handler {
+	return &moduleHandler{h: m.h.WithGroup(name), levels: m.levels, module: m.module}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	var out bytes.Buffer
+	levels := NewLevels(slog.LevelInfo)
+	logger := slog.New(NewHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}), levels))
+	server := logger.With(ModuleKey, "server")
+	kafka := logger.With(ModuleKey, "kafka").With("connection id", 1)
+
+	server.Debug("server debug 1")
+	kafka.Debug("kafka debug 1")
+	levels.Set("kafka", slog.LevelDebug)
+	server.Debug("server debug 2")
+	kafka.Debug("kafka debug 2")
+	levels.Reset("kafka")
+	kafka.Debug("kafka debug 3")
+	levels.Set("", slog.LevelDebug)
+	server.Debug("server debug 4")
+
+	logs := out.String()
+	for _, msg := range []string{"kafka debug 2", "server debug 4"} {
+		if !strings.Contains(logs, msg) {
+			t.Fatalf("Expected %q to be logged, got:\n%s", msg, logs)
+		}
+	}
+	for _, msg := range []string{"server debug 1", "kafka debug 1", "server debug 2", "kafka debug 3"} {
+		if strings.Contains(logs, msg) {
+			t.Fatalf("Expected %q not to be logged, got:\n%s", msg, logs)
+		}
+	}
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatalf("Expected the default level to apply to loggers without module")
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]slog.Level
+		wantErr bool
+	}{
+		{"Empty", "", map[string]slog.Level{"": slog.LevelInfo}, false},
+		{
+			"Several modules", "server=debug, kafka=WARN",
+			map[string]slog.Level{"": slog.LevelInfo, "server": slog.LevelDebug, "kafka": slog.LevelWarn}, false,
+		},
+		{"Unknown level", "server=verbose", nil, true},
+		{"Missing module", "=debug", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				levels := NewLevels(slog.LevelInfo)
+				err := levels.ParseLevels(tt.s)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ParseLevels() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if tt.wantErr {
+					return
+				}
+				got := levels.All()
+				if len(got) != len(tt.want) {
+					t.Fatalf("ParseLevels() got = %v, want %v", got, tt.want)
+				}
+				for module, level := range tt.want {
+					if got[module] != level {
+						t.Fatalf("ParseLevels() got = %v, want %v", got, tt.want)
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestModuleCachesLoggers(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var out bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	if Module("server") != Module("server") {
+		t.Fatalf("Expected the logger of a module to be cached")
+	}
+	allocs := testing.AllocsPerRun(
+		100, func() {
+			Module("server")
+		},
+	)
+	if allocs != 0 {
+		t.Fatalf("Expected getting the logger of a module not to allocate, got %v allocations", allocs)
+	}
+
+	// The cached loggers follow the default logger
+	var replaced bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&replaced, nil)))
+	Module("server").Info("after replacing the default logger")
+	if out.Len() != 0 || !strings.Contains(replaced.String(), "module=server") {
+		t.Fatalf("Expected the log to go to the new default logger, got %q and %q", out.String(), replaced.String())
+	}
+}
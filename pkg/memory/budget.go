@@ -0,0 +1,183 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package memory sizes the memory held by the broker from the memory available to the process, so that kcore running
+// in a container stays below its limit instead of being killed.
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CgroupRoot is where the cgroup filesystem is mounted.
+const CgroupRoot = "/sys/fs/cgroup"
+
+// unlimited is the threshold above which a cgroup v1 limit means no limit, the kernel reports a page aligned
+// math.MaxInt64 for unlimited groups.
+const unlimited = 1 << 62
+
+// ProcCgroupFile lists the cgroups of the process.
+const ProcCgroupFile = "/proc/self/cgroup"
+
+// CgroupLimit returns the memory limit of the cgroup of the process, as listed in /proc/self/cgroup, for cgroup v2 and
+// v1 hierarchies mounted at root. The limits of the parents of the cgroup apply as well, the lowest one is returned.
+// It returns false if there is no limit or no cgroup filesystem, e.g. outside Linux.
+func CgroupLimit(root string) (int64, bool) {
+	// Without the list, e.g. outside Linux, only the cgroup at root is looked at
+	cgroups, _ := os.ReadFile(ProcCgroupFile)
+	return cgroupLimit(root, string(cgroups))
+}
+
+// cgroupLimit returns the memory limit of the cgroup listed in cgroups, in the format of /proc/self/cgroup, under the
+// hierarchies mounted at root. The cgroup v2 hierarchy is preferred when both are mounted.
+func cgroupLimit(root string, cgroups string) (int64, bool) {
+	v2, v1 := "/", "/"
+	for _, line := range strings.Split(cgroups, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path, the cgroup v2 hierarchy has ID 0 and no controllers
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2 = fields[2]
+		} else if slices.Contains(strings.Split(fields[1], ","), "memory") {
+			v1 = fields[2]
+		}
+	}
+	limit, found := hierarchyLimit(root, v2, "memory.max")
+	if !found {
+		limit, found = hierarchyLimit(filepath.Join(root, "memory"), v1, "memory.limit_in_bytes")
+	}
+	return limit, limit > 0
+}
+
+// hierarchyLimit returns the lowest limit of the cgroup at path in the hierarchy mounted at dir and of its parents, or
+// 0 if none of them is limited. It returns false if the hierarchy has no limit file at all.
+//
+// The cgroup may not be found under dir, e.g. when the cgroup of a container is mounted at root without a cgroup
+// namespace, its parents up to dir are looked at then.
+func hierarchyLimit(dir, path, file string) (int64, bool) {
+	var lowest int64
+	found := false
+	for path = filepath.Clean("/" + path); ; path = filepath.Dir(path) {
+		limit, err := readLimit(filepath.Join(dir, path, file))
+		if err == nil {
+			found = true
+			if limit > 0 && (lowest == 0 || limit < lowest) {
+				lowest = limit
+			}
+		}
+		if path == "/" {
+			return lowest, found
+		}
+	}
+}
+
+// readLimit reads a cgroup memory limit file, it returns 0 if the cgroup has no limit.
+func readLimit(file string) (int64, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "max" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit in %s: %w", file, err)
+	}
+	if limit <= 0 || limit >= unlimited {
+		return 0, nil
+	}
+	return limit, nil
+}
+
+// Limit returns the soft memory limit of the Go runtime, set with GOMEMLIMIT or SetCgroupMemoryLimit, or 0 if there
+// is none.
+func Limit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0
+	}
+	return limit
+}
+
+// SetCgroupMemoryLimit sets the soft memory limit of the Go runtime to fraction of the cgroup limit, leaving the rest
+// for the memory the runtime does not account for, so that the garbage collector works harder before the process
+// reaches the cgroup limit. A limit set with GOMEMLIMIT takes precedence. It returns the limit of the runtime.
+func SetCgroupMemoryLimit(root string, fraction float64) int64 {
+	if os.Getenv("GOMEMLIMIT") != "" {
+		return Limit()
+	}
+	if limit, ok := CgroupLimit(root); ok {
+		debug.SetMemoryLimit(int64(float64(limit) * fraction))
+	}
+	return Limit()
+}
+
+// Budget divides a memory limit among the components of the broker that hold memory, e.g. the requests queued by the
+// MemoryPool, so that together they can't use more than the limit.
+type Budget struct {
+	total int64
+
+	mu     sync.Mutex
+	shares map[string]float64
+	free   float64
+}
+
+// NewBudget creates a budget of total bytes. A total of 0 means there is no limit to divide.
+func NewBudget(total int64) *Budget {
+	return &Budget{total: total, shares: make(map[string]float64), free: 1}
+}
+
+// Reserve reserves fraction of the budget for the component and returns its size in bytes, or 0 if the budget has no
+// limit. It fails if the fractions reserved add up to more than the whole budget.
+func (b *Budget) Reserve(component string, fraction float64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.shares[component]; ok {
+		return 0, fmt.Errorf("memory is already reserved for %s", component)
+	}
+	if fraction <= 0 || fraction > b.free+1e-9 {
+		return 0, fmt.Errorf(
+			"can't reserve %.0f%% of the memory for %s, %.0f%% is left", fraction*100, component, b.free*100,
+		)
+	}
+	b.shares[component] = fraction
+	b.free -= fraction
+	return int64(float64(b.total) * fraction), nil
+}
+
+// LogValue implements slog.LogValuer, logging the bytes reserved for each component.
+func (b *Budget) LogValue() slog.Value {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	attrs := []slog.Attr{slog.Int64("total", b.total)}
+	for component, fraction := range b.shares {
+		attrs = append(attrs, slog.Int64(component, int64(float64(b.total)*fraction)))
+	}
+	return slog.GroupValue(attrs...)
+}
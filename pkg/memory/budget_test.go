@@ -0,0 +1,144 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    int64
+		wantOk  bool
+	}{
+		{"cgroup v2 limit", "memory.max", "1073741824\n", 1073741824, true},
+		{"cgroup v2 without limit", "memory.max", "max\n", 0, false},
+		{"cgroup v1 limit", "memory/memory.limit_in_bytes", "536870912\n", 536870912, true},
+		{"cgroup v1 without limit", "memory/memory.limit_in_bytes", "9223372036854771712\n", 0, false},
+		{"No cgroup filesystem", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				if tt.file != "" {
+					path := filepath.Join(root, tt.file)
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						t.Fatalf("Failed to create cgroup directory: %v", err)
+					}
+					if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+						t.Fatalf("Failed to write cgroup file: %v", err)
+					}
+				}
+				got, ok := CgroupLimit(root)
+				if got != tt.want || ok != tt.wantOk {
+					t.Fatalf("Expected (%d, %v), got (%d, %v)", tt.want, tt.wantOk, got, ok)
+				}
+			},
+		)
+	}
+}
+
+// Test_cgroupLimit tests that the limit is read from the cgroup of the process and from its parents
+func Test_cgroupLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		cgroups string
+		want    int64
+		wantOk  bool
+	}{
+		{
+			"cgroup v2 of the process",
+			map[string]string{"memory.max": "max\n", "kcore.slice/kcore.service/memory.max": "1073741824\n"},
+			"0::/kcore.slice/kcore.service\n", 1073741824, true,
+		},
+		{
+			"cgroup v2 limited by a parent",
+			map[string]string{
+				"kcore.slice/memory.max": "536870912\n", "kcore.slice/kcore.service/memory.max": "1073741824\n",
+			},
+			"0::/kcore.slice/kcore.service\n", 536870912, true,
+		},
+		{
+			"cgroup v2 of the process without limit",
+			map[string]string{"memory.max": "1073741824\n", "kcore.slice/memory.max": "max\n"},
+			"0::/kcore.slice\n", 1073741824, true,
+		},
+		{
+			"cgroup v1 of the process",
+			map[string]string{
+				"memory/memory.limit_in_bytes":       "9223372036854771712\n",
+				"memory/kcore/memory.limit_in_bytes": "536870912\n",
+			},
+			"12:cpu,cpuacct:/other\n4:memory:/kcore\n", 536870912, true,
+		},
+		{
+			"cgroup of a container mounted at root",
+			map[string]string{"memory.max": "268435456\n"},
+			"0::/docker/0123456789ab\n", 268435456, true,
+		},
+		{"Unlimited root cgroup", map[string]string{"memory.max": "max\n"}, "0::/\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				for file, content := range tt.files {
+					path := filepath.Join(root, file)
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						t.Fatalf("Failed to create cgroup directory: %v", err)
+					}
+					if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+						t.Fatalf("Failed to write cgroup file: %v", err)
+					}
+				}
+				got, ok := cgroupLimit(root, tt.cgroups)
+				if got != tt.want || ok != tt.wantOk {
+					t.Fatalf("Expected (%d, %v), got (%d, %v)", tt.want, tt.wantOk, got, ok)
+				}
+			},
+		)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(1000)
+	queued, err := budget.Reserve("queued requests", 0.25)
+	if err != nil || queued != 250 {
+		t.Fatalf("Expected 250 bytes for the queued requests, got %d, error %v", queued, err)
+	}
+	if _, err = budget.Reserve("queued requests", 0.1); err == nil {
+		t.Fatalf("Expected an error when reserving memory twice for the same component")
+	}
+	if _, err = budget.Reserve("index cache", 0.8); err == nil {
+		t.Fatalf("Expected an error when reserving more than the budget")
+	}
+	cache, err := budget.Reserve("index cache", 0.75)
+	if err != nil || cache != 750 {
+		t.Fatalf("Expected 750 bytes for the index cache, got %d, error %v", cache, err)
+	}
+
+	if size, err := NewBudget(0).Reserve("queued requests", 0.25); err != nil || size != 0 {
+		t.Fatalf("Expected no limit from an unlimited budget, got %d, error %v", size, err)
+	}
+}
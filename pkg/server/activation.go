@@ -0,0 +1,96 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, after stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// EnvUpgradeFDs and EnvUpgradeFDNames pass the listening sockets to the new process of a hot upgrade, like LISTEN_FDS
+// and LISTEN_FDNAMES. LISTEN_PID can't be used since the PID of the new process is not known before it starts.
+const (
+	EnvUpgradeFDs     = "KCORE_LISTEN_FDS"
+	EnvUpgradeFDNames = "KCORE_LISTEN_FDNAMES"
+)
+
+// InheritedListener is a listening socket passed to the process by its parent, e.g. systemd socket activation.
+type InheritedListener struct {
+	// Name is the name given to the socket by the parent (FileDescriptorName= in systemd), if any.
+	Name     string
+	Listener net.Listener
+}
+
+// InheritListeners returns the listening sockets passed to the process following the systemd socket activation
+// protocol (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES), or by the kcore process it upgrades (EnvUpgradeFDs and
+// EnvUpgradeFDNames). Like sd_listen_fds, the systemd sockets are ignored unless LISTEN_PID is the PID of the process.
+// The environment variables are unset so that they are not passed down to child processes. It returns no listeners if
+// the process was neither socket activated nor upgraded.
+func InheritListeners() ([]InheritedListener, error) {
+	pid, count, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	upgradeCount, upgradeNames := os.Getenv(EnvUpgradeFDs), os.Getenv(EnvUpgradeFDNames)
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", EnvUpgradeFDs, EnvUpgradeFDNames} {
+		os.Unsetenv(env)
+	}
+	if upgradeCount != "" {
+		return inheritListeners(upgradeCount, upgradeNames)
+	}
+	if count == "" || pid != strconv.Itoa(os.Getpid()) {
+		// Not socket activated, or the sockets were meant for another process
+		return nil, nil
+	}
+	return inheritListeners(count, names)
+}
+
+// inheritListeners creates a listener for each of the count file descriptors following stderr, named by the colon
+// separated names.
+func inheritListeners(count string, names string) ([]InheritedListener, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid number of inherited file descriptors %q", count)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	listeners := make([]InheritedListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		// FileListener duplicates the file descriptor, the original one is no longer needed
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, inherited := range listeners {
+				inherited.Listener.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d is not a listening socket: %w", listenFdsStart+i, err)
+		}
+		listeners = append(listeners, InheritedListener{Name: name, Listener: l})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"kcore/pkg/clock"
+)
+
+// maxTrackedAuthFailures is the maximum number of keys tracked by the throttle. Once reached, the key that failed the
+// longest ago is forgotten to make room, so that failures spread over many client IPs can't grow it without bound.
+const maxTrackedAuthFailures = 10000
+
+// AuthFailureThrottle tracks failed authentications per key (a client IP or a principal) and slows down clients that
+// keep failing: the connection is closed after a delay that doubles with every consecutive failure and, once the ban
+// threshold is reached, new connections are rejected until the ban expires.
+type AuthFailureThrottle struct {
+	// Delay is the delay applied before closing a connection after its first failure.
+	Delay time.Duration
+	// MaxDelay caps the delay applied after consecutive failures.
+	MaxDelay time.Duration
+	// BanThreshold is the number of consecutive failures after which the key is banned. 0 disables bans.
+	BanThreshold int
+	// BanDuration is how long a key stays banned.
+	BanDuration time.Duration
+	// ResetAfter is the time without failures after which a key is forgotten.
+	ResetAfter time.Duration
+
+	clock    clock.Clock
+	mu       sync.Mutex
+	failures map[string]*authFailures
+	// order lists the failures from the least to the most recently updated, so that the keys to forget are found
+	// without going through all of them.
+	order *list.List
+}
+
+type authFailures struct {
+	key         string
+	count       int
+	last        time.Time
+	bannedUntil time.Time
+	elem        *list.Element
+}
+
+// NewAuthFailureThrottle creates a throttle that delays closing connections by delay after a failure, doubling up to
+// maxDelay, and bans keys for banDuration after banThreshold consecutive failures.
+func NewAuthFailureThrottle(
+	delay time.Duration,
+	maxDelay time.Duration,
+	banThreshold int,
+	banDuration time.Duration,
+) *AuthFailureThrottle {
+	return &AuthFailureThrottle{
+		Delay:        delay,
+		MaxDelay:     maxDelay,
+		BanThreshold: banThreshold,
+		BanDuration:  banDuration,
+		ResetAfter:   max(10*maxDelay, banDuration, time.Minute),
+		clock:        clock.Real,
+		failures:     make(map[string]*authFailures),
+		order:        list.New(),
+	}
+}
+
+// WithClock sets the clock used to expire bans and forget failures.
+func (t *AuthFailureThrottle) WithClock(c clock.Clock) *AuthFailureThrottle {
+	t.clock = c
+	return t
+}
+
+// Failure records a failed authentication for the key and returns how long to wait before closing the connection.
+func (t *AuthFailureThrottle) Failure(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	t.sweep(now)
+	f, ok := t.failures[key]
+	if ok && now.Sub(f.last) > t.ResetAfter {
+		t.remove(f)
+		ok = false
+	}
+	if !ok {
+		if len(t.failures) >= maxTrackedAuthFailures {
+			t.remove(t.order.Front().Value.(*authFailures))
+		}
+		f = &authFailures{key: key}
+		f.elem = t.order.PushBack(f)
+		t.failures[key] = f
+	} else {
+		t.order.MoveToBack(f.elem)
+	}
+	f.count++
+	f.last = now
+	if t.BanThreshold > 0 && f.count >= t.BanThreshold {
+		f.bannedUntil = now.Add(t.BanDuration)
+	}
+
+	delay := t.Delay
+	for i := 1; i < f.count && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, t.MaxDelay)
+}
+
+// Success forgets the failures of the key.
+func (t *AuthFailureThrottle) Success(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.failures[key]; ok {
+		t.remove(f)
+	}
+}
+
+// Banned returns true if the key failed too many times and is not allowed to connect.
+func (t *AuthFailureThrottle) Banned(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	return ok && t.clock.Now().Before(f.bannedUntil)
+}
+
+// sweep forgets the keys that failed more than ResetAfter ago and are not banned, oldest first. It stops at the first
+// key to keep, its cost is spread over the failures. t.mu must be held.
+func (t *AuthFailureThrottle) sweep(now time.Time) {
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		f := e.Value.(*authFailures)
+		if now.Sub(f.last) <= t.ResetAfter || !now.After(f.bannedUntil) {
+			return
+		}
+		t.remove(f)
+	}
+}
+
+// remove forgets the failures of a key. t.mu must be held.
+func (t *AuthFailureThrottle) remove(f *authFailures) {
+	t.order.Remove(f.elem)
+	delete(t.failures, f.key)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"kcore/pkg/clock"
+)
+
+func TestAuthFailureThrottleBackoff(t *testing.T) {
+	throttle := NewAuthFailureThrottle(100*time.Millisecond, 500*time.Millisecond, 0, 0)
+
+	want := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond,
+		500 * time.Millisecond,
+	}
+	for i, w := range want {
+		if got := throttle.Failure("10.0.0.1"); got != w {
+			t.Fatalf("Failure %d: expected a delay of %s, got %s", i+1, w, got)
+		}
+	}
+	if got := throttle.Failure("10.0.0.2"); got != 100*time.Millisecond {
+		t.Fatalf("Expected failures to be tracked per key, got a delay of %s", got)
+	}
+
+	throttle.Success("10.0.0.1")
+	if got := throttle.Failure("10.0.0.1"); got != 100*time.Millisecond {
+		t.Fatalf("Expected a success to reset the delay, got %s", got)
+	}
+	if throttle.Banned("10.0.0.1") {
+		t.Fatalf("Expected bans to be disabled")
+	}
+}
+
+func TestAuthFailureThrottleBan(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	throttle := NewAuthFailureThrottle(time.Millisecond, time.Millisecond, 3, time.Minute).WithClock(c)
+
+	for i := 0; i < 2; i++ {
+		throttle.Failure("10.0.0.1")
+	}
+	if throttle.Banned("10.0.0.1") {
+		t.Fatalf("Expected the key not to be banned before reaching the threshold")
+	}
+	throttle.Failure("10.0.0.1")
+	if !throttle.Banned("10.0.0.1") {
+		t.Fatalf("Expected the key to be banned after reaching the threshold")
+	}
+	if throttle.Banned("10.0.0.2") {
+		t.Fatalf("Expected other keys not to be banned")
+	}
+	c.Advance(59 * time.Second)
+	if !throttle.Banned("10.0.0.1") {
+		t.Fatalf("Expected the key to be banned until the ban expires")
+	}
+	c.Advance(time.Second)
+	if throttle.Banned("10.0.0.1") {
+		t.Fatalf("Expected the ban to expire")
+	}
+}
+
+func TestAuthFailureThrottleBounded(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	throttle := NewAuthFailureThrottle(time.Millisecond, time.Millisecond, 1, time.Minute).WithClock(c)
+	for i := 0; i <= maxTrackedAuthFailures; i++ {
+		throttle.Failure("10.0.0." + strconv.Itoa(i))
+	}
+	if len(throttle.failures) != maxTrackedAuthFailures || throttle.order.Len() != maxTrackedAuthFailures {
+		t.Fatalf("Expected %d tracked keys, got %d", maxTrackedAuthFailures, len(throttle.failures))
+	}
+	if throttle.Banned("10.0.0.0") {
+		t.Fatalf("Expected the oldest key to be forgotten")
+	}
+	if !throttle.Banned("10.0.0." + strconv.Itoa(maxTrackedAuthFailures)) {
+		t.Fatalf("Expected the newest key to be banned")
+	}
+
+	// The keys that failed long ago are forgotten as new failures come in
+	c.Advance(throttle.ResetAfter + time.Second)
+	throttle.Failure("10.0.0.1")
+	if len(throttle.failures) != 1 || throttle.order.Len() != 1 {
+		t.Fatalf("Expected the idle keys to be forgotten, got %d tracked keys", len(throttle.failures))
+	}
+}
@@ -17,12 +17,25 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"kcore/pkg/chaos"
+	"kcore/pkg/logging"
 )
 
+// TLSHandshakeTimeout is the maximum time a client has to complete the TLS handshake after connecting.
+const TLSHandshakeTimeout = 10 * time.Second
+
 // ConnectionHandler is an interface for handling a single connection and will run in its own goroutine.
 type ConnectionHandler interface {
 	// HandleConnection handles a single connection.
@@ -34,65 +47,428 @@ type ConnectionHandler interface {
 
 type ConnectionHandlerFactory func() ConnectionHandler
 
+// Drainer is implemented by the ConnectionHandlers that can wait for something else than data from the client, e.g. for
+// memory to read the next request, which the read deadlines set by Shutdown don't interrupt.
+type Drainer interface {
+	// Drain stops the waits of the handler so that HandleConnection returns once the request being handled is done. It
+	// may be called from another goroutine, before HandleConnection.
+	Drain()
+}
+
 // TCPServer is a simple TCP server that listens for incoming connections and handles them with a ConnectionHandler.
+// It can also listen on a unix domain socket, see NewUnixServer.
 type TCPServer struct {
+	network        string
 	address        string
 	port           int
 	handlerFactory ConnectionHandlerFactory
-	l              net.Listener
+	tlsConfig      *tls.Config
+	authThrottle   *AuthFailureThrottle
+	reusePort      bool
+	// inherited is a listening socket passed to the process that is used instead of opening a new one.
+	inherited net.Listener
+	// raw is the listening socket, l wraps it with TLS when enabled.
+	raw net.Listener
+	l   net.Listener
+
+	// acceptDone is closed when the accept loop returns.
+	acceptDone chan struct{}
+
+	mu sync.Mutex
+	// conns maps the open connections to their handler if it is a Drainer, nil otherwise.
+	conns map[net.Conn]Drainer
+	// draining is set by Shutdown, the deadlines of the connections are no longer cleared once it is set.
+	draining bool
+	wg       sync.WaitGroup
 }
 
 // NewTCPServer creates a new TCP server. It does not start the server.
 func NewTCPServer(address string, port int, handlerFactory ConnectionHandlerFactory) *TCPServer {
 	return &TCPServer{
+		network:        "tcp",
 		address:        address,
 		port:           port,
 		handlerFactory: handlerFactory,
+		conns:          make(map[net.Conn]Drainer),
 	}
 }
 
+// NewUnixServer creates a server listening on the unix domain socket at path, for clients running on the same host. It
+// does not start the server.
+func NewUnixServer(path string, handlerFactory ConnectionHandlerFactory) *TCPServer {
+	return &TCPServer{
+		network:        "unix",
+		address:        path,
+		handlerFactory: handlerFactory,
+		conns:          make(map[net.Conn]Drainer),
+	}
+}
+
+// WithTLSConfig makes the server accept TLS connections only. The TLS handshake is completed before the connection is
+// passed to the ConnectionHandler.
+func (s *TCPServer) WithTLSConfig(config *tls.Config) *TCPServer {
+	s.tlsConfig = config
+	return s
+}
+
+// WithAuthFailureThrottle slows down and bans clients that repeatedly fail to authenticate, e.g. with an invalid client
+// certificate.
+func (s *TCPServer) WithAuthFailureThrottle(throttle *AuthFailureThrottle) *TCPServer {
+	s.authThrottle = throttle
+	return s
+}
+
+// WithListener makes the server accept connections from an already open listener, e.g. one inherited through systemd
+// socket activation, instead of listening on its address and port.
+func (s *TCPServer) WithListener(l net.Listener) *TCPServer {
+	s.inherited = l
+	return s
+}
+
+// WithReusePort sets SO_REUSEPORT on the listening socket so that another process, e.g. a newer kcore binary, can
+// listen on the same address and port while this one drains its connections. Only supported on unix systems.
+func (s *TCPServer) WithReusePort() *TCPServer {
+	s.reusePort = true
+	return s
+}
+
 // Start starts the TCP server in a new goroutine.
 func (s *TCPServer) Start() error {
-	slog.Debug("Starting TCP server", "address", s.address, "port", s.port)
-	l, err := net.Listen("tcp", s.address+":"+strconv.Itoa(s.port))
-	if err != nil {
-		slog.Error("Failed to start TCP server: %s", err)
-		return err
+	logger().Debug("Starting TCP server", "address", s.address, "port", s.port)
+	l := s.inherited
+	if l != nil {
+		logger().Debug("Using inherited listener", "address", l.Addr().String())
+		s.inherited = nil
+	} else {
+		var err error
+		config := net.ListenConfig{}
+		if s.reusePort && s.network == "tcp" {
+			config.Control = reusePortControl
+		}
+		var address string
+		if address, err = s.listenAddress(); err == nil {
+			l, err = config.Listen(context.Background(), s.network, address)
+		}
+		if err != nil {
+			logger().Error("Failed to start TCP server", "error", err)
+			return err
+		}
+	}
+	logger().Debug("TCP server listening", "tls", s.tlsConfig != nil)
+	s.raw = l
+	if chaos.Enabled {
+		faults, err := chaos.FromEnv()
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("invalid %s: %w", chaos.EnvFaults, err)
+		}
+		logger().Warn("Injecting network faults, this build must not be used in production", "faults", faults)
+		l = chaos.NewInjector(faults).WrapListener(l)
+	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
 	}
-	slog.Debug("TCP server listening")
 	s.l = l
+	s.acceptDone = make(chan struct{})
 	go func() {
+		defer close(s.acceptDone)
 		for {
 			// When the server is stopped, the listener is closed and Accept() returns
 			conn, err := l.Accept()
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
-					slog.Debug("Connection closed, can't accept new connections")
+					logger().Debug("Connection closed, can't accept new connections")
 					return
 				}
-				slog.Error("Failed to accept TCP connection", err)
+				logger().Error("Failed to accept TCP connection", "error", err)
 				return
 			}
-			slog.Debug("Accepted new TCP connection", "remote address", conn.RemoteAddr())
+			logger().Debug("Accepted new TCP connection", "remote address", conn.RemoteAddr())
+			if s.authThrottle != nil && s.authThrottle.Banned(remoteIP(conn)) {
+				logger().Debug("Rejecting connection from banned client", "remote address", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
 			// TODO: Limit the number of concurrent connections
-			go s.handlerFactory().HandleConnection(conn)
+			s.track(conn)
+			go s.handle(conn)
 		}
 	}()
 	return nil
 }
 
+// listenAddress returns the address to listen on. IPv6 addresses are bracketed, and the unspecified IPv6 address "::"
+// accepts IPv4 connections as well.
+func (s *TCPServer) listenAddress() (string, error) {
+	if s.network == "unix" {
+		removeStaleSocket(s.address)
+		return s.address, nil
+	}
+	host, err := ResolveInterface(s.address)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.port)), nil
+}
+
+// ResolveInterface returns the address of the network interface named host, so that listeners can be bound to an
+// interface, e.g. eth0, whose address is not known in advance. The IPv4 address of the interface is preferred over its
+// IPv6 addresses. A host that is not the name of an interface is returned as is.
+func ResolveInterface(host string) (string, error) {
+	if host == "" || net.ParseIP(host) != nil {
+		return host, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return host, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the addresses of interface %s: %w", host, err)
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return "", fmt.Errorf("interface %s has no usable address", host)
+	}
+	return ipv6.String(), nil
+}
+
+// removeStaleSocket removes the socket file left behind by a process that did not exit cleanly. Anything else at path,
+// e.g. a regular file or a socket that accepts connections, is left alone and listening on it fails.
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	// Only a refused connection tells that nobody listens, e.g. a full backlog or a permission error does not
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		logger().Debug("Not removing unix socket that may be in use", "path", path, "error", err)
+		return
+	}
+	logger().Debug("Removing stale unix socket", "path", path)
+	if err = os.Remove(path); err != nil {
+		logger().Warn("Failed to remove stale unix socket", "path", path, "error", err)
+	}
+}
+
+func (s *TCPServer) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tlsConn); err != nil {
+			var recordErr tls.RecordHeaderError
+			if s.isDraining() {
+				// The handshake was interrupted by the shutdown, the client is not to blame
+				logger().Debug("Server is shutting down, closing connection", "remote address", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			if errors.As(err, &recordErr) {
+				logger().Warn(
+					"Client did not start a TLS handshake, is it connecting without TLS?",
+					"remote address", conn.RemoteAddr(), "error", err,
+				)
+			} else {
+				logger().Warn("TLS handshake failed", "remote address", conn.RemoteAddr(), "error", err)
+			}
+			if s.authThrottle != nil {
+				// Delay the close so that a client retrying in a loop can't keep the broker busy with handshakes
+				time.Sleep(s.authThrottle.Failure(remoteIP(conn)))
+			}
+			conn.Close()
+			return
+		}
+		if s.authThrottle != nil {
+			s.authThrottle.Success(remoteIP(conn))
+		}
+		state := tlsConn.ConnectionState()
+		logger().Debug(
+			"TLS handshake completed", "remote address", conn.RemoteAddr(), "resumed", state.DidResume,
+			"protocol", state.NegotiatedProtocol,
+		)
+	}
+	handler := s.handlerFactory()
+	s.attach(conn, handler)
+	handler.HandleConnection(conn)
+}
+
+// errDraining is returned for the connections whose handshake did not start before the server was shut down.
+var errDraining = errors.New("server is shutting down")
+
+// handshake completes the TLS handshake of conn within TLSHandshakeTimeout. The deadlines are left alone once the
+// server is draining, so that the handshake, or the first read that follows it, fails right away.
+func (s *TCPServer) handshake(conn *tls.Conn) error {
+	if !s.setDeadline(conn, time.Now().Add(TLSHandshakeTimeout)) {
+		return errDraining
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	s.setDeadline(conn, time.Time{})
+	return nil
+}
+
+// setDeadline sets the deadline of conn, unless the server is draining. It returns false if the server is draining.
+func (s *TCPServer) setDeadline(conn net.Conn, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	// The error can only be that the connection is closed, which the next read reports
+	conn.SetDeadline(t)
+	return true
+}
+
+func (s *TCPServer) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
 // Stop stops the TCP server.
 func (s *TCPServer) Stop() error {
-	slog.Debug("Stopping TCP server", "address", s.address, "port", s.port)
+	logger().Debug("Stopping TCP server", "address", s.address, "port", s.port)
 	if s.l == nil {
-		slog.Debug("TCP server not running")
+		logger().Debug("TCP server not running")
 		return nil
 	}
 	err := s.l.Close()
 	if err != nil {
-		slog.Error("Failed to stop TCP server", err)
+		logger().Error("Failed to stop TCP server", "error", err)
 		return err
 	}
 	s.l = nil
 	return nil
 }
+
+// Shutdown stops accepting new connections and drains the open ones: connections waiting for data, or handlers that are
+// Drainers, are woken up so that the handlers return once they finished the request they are handling. When ctx is
+// done, the remaining connections are closed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	err := s.Stop()
+	// No connection is tracked once the accept loop returned, so that the wait group is not added to while waited for
+	if s.acceptDone != nil {
+		<-s.acceptDone
+	}
+	s.mu.Lock()
+	s.draining = true
+	for conn, drainer := range s.conns {
+		// Reads fail immediately from now on, pending writes are not affected
+		conn.SetReadDeadline(time.Now())
+		if drainer != nil {
+			drainer.Drain()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger().Debug("All connections closed", "address", s.address, "port", s.port)
+	case <-ctx.Done():
+		s.mu.Lock()
+		logger().Info(
+			"Closing connections that did not finish in time", "address", s.address, "port", s.port,
+			"connections", len(s.conns),
+		)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+	return err
+}
+
+// Connections returns the number of open connections.
+func (s *TCPServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Addr returns the address the server is listening on, e.g. to find the port picked by the system when listening on
+// port 0. The server must be started.
+func (s *TCPServer) Addr() net.Addr {
+	return s.raw.Addr()
+}
+
+// File returns a duplicate of the listening socket so that it can be passed to another process. The server must be
+// started.
+//
+// The socket file of a unix server is left in place when the server is stopped from then on, since the other process
+// keeps accepting connections on it. If it does not, the file is removed as stale on the next start.
+func (s *TCPServer) File() (*os.File, error) {
+	filer, ok := s.raw.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T does not support file descriptors", s.raw)
+	}
+	if unix, ok := s.raw.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+	return filer.File()
+}
+
+func (s *TCPServer) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = nil
+	s.wg.Add(1)
+}
+
+// attach records the handler of a tracked connection so that Shutdown can drain it. The handler is drained right away
+// if the server is already draining.
+func (s *TCPServer) attach(conn net.Conn, handler ConnectionHandler) {
+	drainer, ok := handler.(Drainer)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		drainer.Drain()
+		return
+	}
+	s.conns[conn] = drainer
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// logger returns the logger of the server module, whose level can be changed at runtime.
+func logger() *slog.Logger {
+	return logging.Module("server")
+}
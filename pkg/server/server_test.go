@@ -17,17 +17,29 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -52,7 +64,7 @@ func (h *MockConnectionHandler) HandleConnection(conn net.Conn) {
 				slog.Debug("EOF reached, no more data to read from connection")
 				return
 			}
-			slog.Error("Failed to read from connection", err)
+			slog.Error("Failed to read from connection", "error", err)
 			return
 		}
 		if n == 0 {
@@ -209,3 +221,571 @@ func TestParallelClients(t *testing.T) {
 		}
 	}
 }
+
+// TestTLS tests that a TLS server hands connections to the handler only after a successful handshake
+func TestTLS(t *testing.T) {
+	cert := newSelfSignedCertificate(t)
+	mc := make(chan []byte, 1)
+	s := NewTCPServer(
+		TEST_ADDRESS, TEST_PORT, func() ConnectionHandler {
+			return &MockConnectionHandler{
+				messageHandler: func(message []byte, conn net.Conn) {
+					mc <- message
+				},
+			}
+		},
+	).WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	defer s.Stop()
+
+	// A plaintext client must be disconnected without reaching the handler
+	conn, err := net.Dial("tcp", TEST_ADDRESS+":"+strconv.Itoa(TEST_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect to TCP server: %s", err)
+	}
+	if _, err = conn.Write([]byte("Message 0")); err != nil {
+		t.Fatalf("Failed to write to TCP server: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the server to close the plaintext connection, got %s", err)
+	}
+	conn.Close()
+	select {
+	case message := <-mc:
+		t.Fatalf("Plaintext message reached the handler: %s", message)
+	default:
+	}
+
+	// A TLS client completes the handshake and reaches the handler
+	tlsConn, err := tls.Dial(
+		"tcp", TEST_ADDRESS+":"+strconv.Itoa(TEST_PORT), &tls.Config{InsecureSkipVerify: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect to TLS server: %s", err)
+	}
+	defer tlsConn.Close()
+	if _, err = tlsConn.Write([]byte("Message 1")); err != nil {
+		t.Fatalf("Failed to write to TLS server: %s", err)
+	}
+	select {
+	case message := <-mc:
+		if string(message) != "Message 1" {
+			t.Fatalf("Received message is not the same as the sent message: received %s, expected Message 1", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the message")
+	}
+}
+
+func newSelfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kcore"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP(TEST_ADDRESS)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestWithListener tests that the server accepts connections from a listener opened outside the server
+func TestWithListener(t *testing.T) {
+	l, err := net.Listen("tcp", TEST_ADDRESS+":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	mc := make(chan []byte, 1)
+	s := NewTCPServer(
+		TEST_ADDRESS, TEST_PORT, func() ConnectionHandler {
+			return &MockConnectionHandler{
+				messageHandler: func(message []byte, conn net.Conn) {
+					mc <- message
+				},
+			}
+		},
+	).WithListener(l)
+	if err = s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to TCP server: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("Message 0")); err != nil {
+		t.Fatalf("Failed to write to TCP server: %s", err)
+	}
+	select {
+	case message := <-mc:
+		if string(message) != "Message 0" {
+			t.Fatalf("Received message is not the same as the sent message: received %s, expected Message 0", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the message")
+	}
+}
+
+// TestInheritListenersForAnotherProcess tests that systemd sockets are ignored unless LISTEN_PID is the PID of the
+// process
+func TestInheritListenersForAnotherProcess(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+	}{
+		{"Another process", strconv.Itoa(os.Getpid() + 1)},
+		{"No pid", ""},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				t.Setenv("LISTEN_PID", tt.pid)
+				t.Setenv("LISTEN_FDS", "1")
+				listeners, err := InheritListeners()
+				if err != nil {
+					t.Fatalf("Failed to inherit listeners: %s", err)
+				}
+				if len(listeners) != 0 {
+					t.Fatalf("Expected no listeners, got %d", len(listeners))
+				}
+				if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+					t.Fatalf("Expected LISTEN_FDS to be unset")
+				}
+			},
+		)
+	}
+}
+
+// TestShutdownDrainsConnections tests that idle connections are closed when the server shuts down
+func TestShutdownDrainsConnections(t *testing.T) {
+	s := NewTCPServer(
+		TEST_ADDRESS, TEST_PORT, func() ConnectionHandler {
+			return &MockConnectionHandler{messageHandler: func(message []byte, conn net.Conn) {}}
+		},
+	)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	conn, err := net.Dial("tcp", TEST_ADDRESS+":"+strconv.Itoa(TEST_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect to TCP server: %s", err)
+	}
+	defer conn.Close()
+	for s.Connections() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down server: %s", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatalf("Expected the idle connection to be drained before the shutdown timeout")
+	}
+	if s.Connections() != 0 {
+		t.Fatalf("Expected no open connections, got %d", s.Connections())
+	}
+}
+
+// waitingHandler waits for Drain instead of reading from the connection, like a handler waiting for memory.
+type waitingHandler struct {
+	drained chan struct{}
+	once    sync.Once
+}
+
+func (h *waitingHandler) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+	<-h.drained
+}
+
+func (h *waitingHandler) Drain() {
+	h.once.Do(
+		func() {
+			close(h.drained)
+		},
+	)
+}
+
+// TestShutdownDrainsDrainers tests that the handlers waiting for something else than data are drained as well
+func TestShutdownDrainsDrainers(t *testing.T) {
+	s := NewTCPServer(
+		TEST_ADDRESS, TEST_PORT, func() ConnectionHandler {
+			return &waitingHandler{drained: make(chan struct{})}
+		},
+	)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	conn, err := net.Dial("tcp", TEST_ADDRESS+":"+strconv.Itoa(TEST_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect to TCP server: %s", err)
+	}
+	defer conn.Close()
+	for s.Connections() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down server: %s", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatalf("Expected the waiting handler to be drained before the shutdown timeout")
+	}
+}
+
+// TestShutdownDuringTLSHandshake tests that a connection still in its TLS handshake is drained, without counting as
+// an authentication failure of the client
+func TestShutdownDuringTLSHandshake(t *testing.T) {
+	throttle := NewAuthFailureThrottle(time.Second, time.Second, 1, time.Minute)
+	s := NewTCPServer(
+		TEST_ADDRESS, TEST_PORT, func() ConnectionHandler {
+			return &MockConnectionHandler{}
+		},
+	).WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{newSelfSignedCertificate(t)}}).
+		WithAuthFailureThrottle(throttle)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	// The client connects but never starts the handshake
+	conn, err := net.Dial("tcp", TEST_ADDRESS+":"+strconv.Itoa(TEST_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect to TCP server: %s", err)
+	}
+	defer conn.Close()
+	for s.Connections() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down server: %s", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatalf("Expected the connection to be drained right away, took %s", time.Since(start))
+	}
+	if throttle.Banned(TEST_ADDRESS) {
+		t.Fatalf("Expected the interrupted handshake not to count as an authentication failure")
+	}
+}
+
+// TestUnixServer tests that the server accepts connections on a unix domain socket and replaces a stale socket file
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcore.sock")
+	// Leave a socket file behind, like a process that was killed would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	mc := make(chan []byte, 1)
+	s := NewUnixServer(
+		path, func() ConnectionHandler {
+			return &MockConnectionHandler{
+				messageHandler: func(message []byte, conn net.Conn) {
+					mc <- message
+				},
+			}
+		},
+	)
+	if err = s.Start(); err != nil {
+		t.Fatalf("Failed to start unix server: %s", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to unix server: %s", err)
+	}
+	if _, err = conn.Write([]byte("Message 0")); err != nil {
+		t.Fatalf("Failed to write to unix server: %s", err)
+	}
+	select {
+	case message := <-mc:
+		if string(message) != "Message 0" {
+			t.Fatalf("Received message is not the same as the sent message: received %s, expected Message 0", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the message")
+	}
+	conn.Close()
+
+	if err = s.Stop(); err != nil {
+		t.Fatalf("Failed to stop server: %s", err)
+	}
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the socket file to be removed, got %v", err)
+	}
+}
+
+// TestUnixServerKeepsExistingFiles tests that the server does not remove what is at its path unless it is a stale
+// socket
+func TestUnixServerKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	factory := func() ConnectionHandler {
+		return &MockConnectionHandler{}
+	}
+
+	file := filepath.Join(dir, "kcore.conf")
+	if err := os.WriteFile(file, []byte("not a socket"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if err := NewUnixServer(file, factory).Start(); err == nil {
+		t.Fatalf("Expected listening on a regular file to fail")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("Expected the regular file to be kept, got %v", err)
+	}
+
+	path := filepath.Join(dir, "kcore.sock")
+	first := NewUnixServer(path, factory)
+	if err := first.Start(); err != nil {
+		t.Fatalf("Failed to start unix server: %s", err)
+	}
+	defer first.Stop()
+	if err := NewUnixServer(path, factory).Start(); err == nil {
+		t.Fatalf("Expected listening on a socket in use to fail")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Expected the socket in use to be kept: %s", err)
+	}
+	conn.Close()
+}
+
+// TestUnixServerHandOver tests that a unix socket passed to another server keeps accepting connections once the
+// server that created it is shut down, as when kcore is upgraded
+func TestUnixServerHandOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcore.sock")
+	mc := make(chan []byte, 1)
+	factory := func() ConnectionHandler {
+		return &MockConnectionHandler{
+			messageHandler: func(message []byte, conn net.Conn) {
+				mc <- message
+			},
+		}
+	}
+	parent := NewUnixServer(path, factory)
+	if err := parent.Start(); err != nil {
+		t.Fatalf("Failed to start unix server: %s", err)
+	}
+	f, err := parent.File()
+	if err != nil {
+		t.Fatalf("Failed to get the socket of the unix server: %s", err)
+	}
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to create listener from file: %s", err)
+	}
+	child := NewUnixServer(path, factory).WithListener(l)
+	if err = child.Start(); err != nil {
+		t.Fatalf("Failed to start unix server: %s", err)
+	}
+	defer child.Stop()
+	if err = parent.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down server: %s", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to unix server once the parent is shut down: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("Message 0")); err != nil {
+		t.Fatalf("Failed to write to unix server: %s", err)
+	}
+	select {
+	case message := <-mc:
+		if string(message) != "Message 0" {
+			t.Fatalf("Received message is not the same as the sent message: received %s, expected Message 0", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the message")
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	} else {
+		l.Close()
+	}
+	mc := make(chan []byte, 2)
+	s := NewTCPServer(
+		"::", 0, func() ConnectionHandler {
+			return &MockConnectionHandler{
+				messageHandler: func(message []byte, conn net.Conn) {
+					mc <- message
+				},
+			}
+		},
+	)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start TCP server: %s", err)
+	}
+	defer s.Stop()
+	port := strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("Failed to connect to TCP server on %s: %s", host, err)
+		}
+		if _, err = conn.Write([]byte("Message 0")); err != nil {
+			t.Fatalf("Failed to write to TCP server: %s", err)
+		}
+		select {
+		case <-mc:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for the message sent to %s", host)
+		}
+		conn.Close()
+	}
+}
+
+func TestResolveInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Failed to list interfaces: %s", err)
+	}
+	loopback := ""
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{"Any address", "", ""},
+		{"IPv6 address", "::1", "::1"},
+		{"Host name", "kcore.example.com", "kcore.example.com"},
+		{"Interface name", loopback, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if tt.host == "" && tt.want != "" {
+					t.Skip("No loopback interface")
+				}
+				got, err := ResolveInterface(tt.host)
+				if err != nil {
+					t.Fatalf("ResolveInterface() error = %v", err)
+				}
+				if got != tt.want {
+					t.Fatalf("Expected %q, got %q", tt.want, got)
+				}
+			},
+		)
+	}
+}
+
+// TestTLSSessionResumption tests that a client resumes its TLS session on a restarted server sharing the ticket keys
+func TestTLSSessionResumption(t *testing.T) {
+	cert := newSelfSignedCertificate(t)
+	keysFile := filepath.Join(t.TempDir(), "ticket-keys")
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(keysFile, []byte("# Current key\n"+hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write session ticket keys: %s", err)
+	}
+	keys, err := LoadSessionTicketKeys(keysFile)
+	if err != nil {
+		t.Fatalf("Failed to load session ticket keys: %s", err)
+	}
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		NextProtos:         []string{"kafka"},
+	}
+
+	for i, wantResumed := range []bool{false, true} {
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"kafka"}}
+		serverConfig.SetSessionTicketKeys(keys)
+		s := NewTCPServer(
+			TEST_ADDRESS, 0, func() ConnectionHandler {
+				return &MockConnectionHandler{
+					messageHandler: func(message []byte, conn net.Conn) {
+						conn.Write(message)
+					},
+				}
+			},
+		).WithTLSConfig(serverConfig)
+		if err = s.Start(); err != nil {
+			t.Fatalf("Failed to start TCP server: %s", err)
+		}
+		conn, err := tls.Dial("tcp", s.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatalf("Failed to connect to TLS server: %s", err)
+		}
+		// Reading makes the client process the session ticket sent after the handshake
+		if _, err = conn.Write([]byte("Message 0")); err != nil {
+			t.Fatalf("Failed to write to TLS server: %s", err)
+		}
+		if _, err = io.ReadFull(conn, make([]byte, MESSAGE_SIZE)); err != nil {
+			t.Fatalf("Failed to read from TLS server: %s", err)
+		}
+		state := conn.ConnectionState()
+		if state.DidResume != wantResumed {
+			t.Fatalf("Connection %d: expected resumed %v, got %v", i, wantResumed, state.DidResume)
+		}
+		if state.NegotiatedProtocol != "kafka" {
+			t.Fatalf("Expected the kafka ALPN protocol to be negotiated, got %q", state.NegotiatedProtocol)
+		}
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestLoadSessionTicketKeys(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{"Keys and comments", "# Rotated on 2024-05-01\n" + key + "\n\n" + key + "\n", 2, false},
+		{"Short key", "abcd\n", 0, true},
+		{"Not hex", strings.Repeat("zz", 32) + "\n", 0, true},
+		{"No keys", "# Nothing yet\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "ticket-keys")
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatalf("Failed to write session ticket keys: %s", err)
+				}
+				got, err := LoadSessionTicketKeys(path)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("LoadSessionTicketKeys() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if len(got) != tt.want {
+					t.Fatalf("Expected %d keys, got %d", tt.want, len(got))
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadSessionTicketKeys reads the keys TLS session tickets are encrypted with from path, one 32 bytes key per line in
+// hex. The first key encrypts new tickets, the others are still accepted so that keys can be rotated without breaking
+// resumption. Sharing the keys across restarts and brokers lets clients resume their sessions on any of them.
+func LoadSessionTicketKeys(path string) ([][32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][32]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(text)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: expected a 32 bytes key in hex", path, line)
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys in %s", path)
+	}
+	return keys, nil
+}
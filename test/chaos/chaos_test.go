@@ -0,0 +1,137 @@
+//go:build chaos
+
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kcore-io/sarama"
+
+	"kcore/pkg/chaos"
+	"kcore/pkg/kafka"
+	"kcore/pkg/kafka/kafkatest"
+	"kcore/pkg/server"
+)
+
+// Requests is the number of requests sent in every scenario, each on a new connection.
+const Requests = 50
+
+var scenarios = []struct {
+	name   string
+	faults string
+	// minSuccesses is the number of requests that must be answered despite the faults.
+	minSuccesses int
+}{
+	{"Slow network", "read-delay=5ms,write-delay=5ms", Requests},
+	{"Partial writes", "partial-writes=0.3,seed=1", 1},
+	{"Connection resets", "resets=0.3,seed=1", 1},
+	{"Everything", "read-delay=1ms,write-delay=1ms,partial-writes=0.2,resets=0.2,seed=1", 1},
+}
+
+func TestScenarios(t *testing.T) {
+	for _, sc := range scenarios {
+		t.Run(
+			sc.name, func(t *testing.T) {
+				t.Setenv(chaos.EnvFaults, sc.faults)
+				s, addr := startServer(t)
+
+				successes := 0
+				for i := 0; i < Requests; i++ {
+					if err := apiVersions(addr, int32(i)); err == nil {
+						successes++
+					}
+				}
+				t.Logf("%d/%d requests answered with faults %q", successes, Requests, sc.faults)
+				if successes < sc.minSuccesses {
+					t.Fatalf("Expected at least %d requests to be answered, got %d", sc.minSuccesses, successes)
+				}
+
+				// Every connection must be released, whatever fault it hit
+				deadline := time.Now().Add(5 * time.Second)
+				for s.Connections() > 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if n := s.Connections(); n > 0 {
+					t.Fatalf("Expected all the connections to be closed, %d are still open", n)
+				}
+			},
+		)
+	}
+}
+
+// startServer starts a server on a free port and returns it with its address.
+func startServer(t *testing.T) (*server.TCPServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	config := kafka.DefaultConfig()
+	pool := kafka.NewMemoryPool(0)
+	clients := kafka.NewClientRegistry()
+	listener := kafka.Listener{Name: "PLAINTEXT", SecurityProtocol: kafka.Plaintext, Host: "127.0.0.1"}
+	s := server.NewTCPServer(
+		"127.0.0.1", 0, func() server.ConnectionHandler {
+			return kafka.NewKafkaConnectionHandler(listener, config, pool, clients, kafka.NewKafkaApi(config, clients))
+		},
+	).WithListener(l)
+	if err = s.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(
+		func() {
+			s.Stop()
+		},
+	)
+	return s, l.Addr().String()
+}
+
+// apiVersions sends an ApiVersions request on a new connection and reads its response.
+func apiVersions(addr string, correlationID int32) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	request := kafkatest.NewRequest(correlationID, "chaos", &sarama.ApiVersionsRequest{Version: 0})
+	buf, err := sarama.Encode(&request, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+	size := make([]byte, 4)
+	if _, err = io.ReadFull(conn, size); err != nil {
+		return err
+	}
+	buf = make([]byte, 4+binary.BigEndian.Uint32(size))
+	copy(buf, size)
+	if _, err = io.ReadFull(conn, buf[4:]); err != nil {
+		return err
+	}
+	resp := &sarama.Response{Body: &sarama.ApiVersionsResponse{}}
+	return sarama.VersionedDecode(buf, resp, kafka.ResponseHeaderVersion, nil)
+}
@@ -0,0 +1,220 @@
+//go:build conformance
+
+/*
+Copyright 2024 KCore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	report    = flag.String("report", "conformance-report.md", "File the compatibility report is written to")
+	bootstrap = flag.String(
+		"bootstrap", "", "Address of the kcore instance to test. A kcore binary is built and started if empty",
+	)
+)
+
+// ScenarioTimeout is the maximum time a client gets to run a scenario.
+const ScenarioTimeout = 30 * time.Second
+
+// scenario is a client invocation exercising some Kafka APIs. Every client starts with an ApiVersions request, so it is
+// not listed.
+type scenario struct {
+	name    string
+	apiKeys []string
+	// args of kcat, the bootstrap address is added before them.
+	args  []string
+	stdin string
+}
+
+var scenarios = []scenario{
+	{name: "List metadata", apiKeys: []string{"Metadata(3)"}, args: []string{"-L"}},
+	{
+		name: "Produce a message", apiKeys: []string{"Metadata(3)", "Produce(0)"},
+		args: []string{"-P", "-t", "conformance"}, stdin: "conformance\n",
+	},
+	{
+		name: "Consume from the beginning", apiKeys: []string{"Metadata(3)", "ListOffsets(2)", "Fetch(1)"},
+		args: []string{"-C", "-t", "conformance", "-o", "beginning", "-c", "1", "-e"},
+	},
+	{
+		name: "Consume in a group",
+		apiKeys: []string{
+			"FindCoordinator(10)", "JoinGroup(11)", "SyncGroup(14)", "Heartbeat(12)", "OffsetFetch(9)",
+			"OffsetCommit(8)", "LeaveGroup(13)",
+		},
+		args: []string{"-G", "conformance", "-c", "1", "-e", "conformance"},
+	},
+}
+
+// implemented are the API keys handled by kcore. The scenarios using other API keys are expected to fail, they are
+// reported as unsupported instead of failing the test.
+var implemented = map[string]bool{
+	"ApiVersions(18)": true,
+}
+
+// expected returns true if every API key used by the scenario is implemented.
+func (sc scenario) expected() bool {
+	for _, key := range sc.apiKeys {
+		if !implemented[key] {
+			return false
+		}
+	}
+	return true
+}
+
+type result struct {
+	scenario scenario
+	err      error
+	output   string
+}
+
+func TestKcat(t *testing.T) {
+	kcat, err := exec.LookPath("kcat")
+	if err != nil {
+		t.Skip("kcat is not installed")
+	}
+	addr := *bootstrap
+	if addr == "" {
+		addr = startKcore(t)
+	}
+
+	var results []result
+	for _, sc := range scenarios {
+		t.Run(
+			sc.name, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), ScenarioTimeout)
+				defer cancel()
+				cmd := exec.CommandContext(ctx, kcat, append([]string{"-b", addr}, sc.args...)...)
+				cmd.Stdin = strings.NewReader(sc.stdin)
+				var out bytes.Buffer
+				cmd.Stdout = &out
+				cmd.Stderr = &out
+				err := cmd.Run()
+				results = append(results, result{scenario: sc, err: err, output: out.String()})
+				switch {
+				case err == nil && !sc.expected():
+					t.Logf("Scenario passed although it uses unimplemented API keys, update implemented")
+				case err != nil && !sc.expected():
+					t.Skipf("kcat %s failed on unsupported API keys: %v", strings.Join(sc.args, " "), err)
+				case err != nil:
+					t.Errorf("kcat %s failed: %v\n%s", strings.Join(sc.args, " "), err, out.String())
+				}
+			},
+		)
+	}
+	if err = writeReport(*report, results); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	t.Logf("Compatibility report written to %s", *report)
+}
+
+// startKcore builds kcore and starts it on a free port, with a data directory of its own, until the end of the test. It
+// returns the bootstrap address.
+func startKcore(t *testing.T) string {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "kcore")
+	build := exec.Command("go", "build", "-o", binary, "kcore/cmd/kcore")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build kcore: %v\n%s", err, out)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cmd := exec.Command(
+		binary, "-address", "127.0.0.1", "-port", fmt.Sprint(port), "-data-dir", t.TempDir(), "-verbose=false",
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("Failed to start kcore: %v", err)
+	}
+	t.Cleanup(
+		func() {
+			cmd.Process.Signal(os.Interrupt)
+			cmd.Wait()
+		},
+	)
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+	}
+	t.Fatalf("kcore did not start listening on %s", addr)
+	return ""
+}
+
+// writeReport writes the results per API key: an API passes if every scenario using it passed, the failing APIs that
+// are not implemented are reported as unsupported.
+func writeReport(path string, results []result) error {
+	supported := make(map[string]bool)
+	for _, r := range results {
+		for _, key := range r.scenario.apiKeys {
+			if ok, seen := supported[key]; !seen || ok {
+				supported[key] = r.err == nil
+			}
+		}
+	}
+	keys := make([]string, 0, len(supported))
+	for key := range supported {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("# kcore conformance report\n\n## API keys\n\n| API | kcat |\n| --- | --- |\n")
+	for _, key := range keys {
+		status := "pass"
+		if !supported[key] {
+			status = "fail"
+			if !implemented[key] {
+				status = "unsupported"
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %s |\n", key, status)
+	}
+	b.WriteString("\n## Scenarios\n\n| Scenario | Result |\n| --- | --- |\n")
+	for _, r := range results {
+		status := "pass"
+		if r.err != nil {
+			status = "fail: " + r.err.Error()
+			if !r.scenario.expected() {
+				status = "unsupported: " + r.err.Error()
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %s |\n", r.scenario.name, status)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}